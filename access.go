@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// perm is permission level of a user to a repository.
+// Higher level includes lower levels.
+type perm int
+
+const (
+	permNone perm = iota
+	permRead
+	permWrite
+	permAdmin
+)
+
+func (p perm) String() string {
+	for n, pp := range permNames {
+		if p == pp {
+			return n
+		}
+	}
+	return "none"
+}
+
+var permNames = map[string]perm{
+	"read":  permRead,
+	"write": permWrite,
+	"admin": permAdmin,
+}
+
+// accessRule gives the permission of the target to the subject.
+//
+// target could be a repository ("group/repo"), a repository group ("group/")
+// or every repository ("*").
+// subject could be a user ("alice"), a user group ("@devs")
+// or everyone including anonymous user ("*").
+type accessRule struct {
+	target  string
+	subject string
+	perm    perm
+}
+
+func (a accessRule) matchRepo(repo string) bool {
+	if a.target == "*" || a.target == repo {
+		return true
+	}
+	return strings.HasSuffix(a.target, "/") && strings.HasPrefix(repo, a.target)
+}
+
+func (a accessRule) matchUser(user string, groups map[string][]string) bool {
+	if a.subject == "*" {
+		return true
+	}
+	if user == "" {
+		return false
+	}
+	if strings.HasPrefix(a.subject, "@") {
+		for _, u := range groups[a.subject[1:]] {
+			if u == user {
+				return true
+			}
+		}
+		return false
+	}
+	return a.subject == user
+}
+
+// readAccessFile parses the access file.
+// A line starts with "@" defines a user group, and other lines are rules.
+// Empty lines and lines start with "#" are ignored.
+//
+//	@devs alice bob
+//	secret @devs write
+//	team/ alice admin
+//
+// When the file does not exist, it returns no rules without error.
+func readAccessFile() ([]accessRule, map[string][]string, error) {
+	groups := make(map[string][]string)
+	f, err := os.Open(accessFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, groups, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	rules := make([]accessRule, 0)
+	s := bufio.NewScanner(f)
+	for i := 1; s.Scan(); i++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		ll := strings.Fields(l)
+		if strings.HasPrefix(ll[0], "@") {
+			groups[ll[0][1:]] = append(groups[ll[0][1:]], ll[1:]...)
+			continue
+		}
+		if len(ll) != 3 {
+			return nil, nil, fmt.Errorf("%v:%v: rule should have target, subject and permission", accessFile, i)
+		}
+		p, ok := permNames[ll[2]]
+		if !ok {
+			return nil, nil, fmt.Errorf("%v:%v: unknown permission: %v", accessFile, i, ll[2])
+		}
+		rules = append(rules, accessRule{target: ll[0], subject: ll[1], perm: p})
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rules, groups, nil
+}
+
+// userGroups returns user groups the user belongs to.
+func userGroups(user string) []string {
+	_, groups, err := readAccessFile()
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	gs := make([]string, 0)
+	for g, users := range groups {
+		for _, u := range users {
+			if u == user {
+				gs = append(gs, g)
+				break
+			}
+		}
+	}
+	sort.Strings(gs)
+	return gs
+}
+
+// repoPerm returns permission of the user to the repo.
+// Anonymous user is represented as empty string.
+//
+// Anonymous user has no permission to a private repo.
+// Admins (see userAdmin) could administrate every repo.
+// If no rule is targeting the repo, every one could read the repo
+// and logged in users could write to it.
+// Otherwise the highest permission from the matched rules is returned.
+func repoPerm(user, repo string) perm {
+	if user == "" && repoPrivate(repo) {
+		return permNone
+	}
+	if userAdmin(user) {
+		return permAdmin
+	}
+	rules, groups, err := readAccessFile()
+	if err != nil {
+		log.Print(err)
+		return permNone
+	}
+	targeted := false
+	p := permNone
+	for _, a := range rules {
+		if !a.matchRepo(repo) {
+			continue
+		}
+		targeted = true
+		if a.matchUser(user, groups) && a.perm > p {
+			p = a.perm
+		}
+	}
+	if !targeted {
+		if user == "" {
+			return permRead
+		}
+		return permWrite
+	}
+	return p
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time   time.Time  `json:"time"`
+	Actor  string     `json:"actor"`
+	IP     string     `json:"ip"`
+	Action string     `json:"action"`
+	Repo   string     `json:"repo,omitempty"`
+	Target string     `json:"target,omitempty"`
+	Refs   []auditRef `json:"refs,omitempty"`
+}
+
+type auditRef struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// auditMutex prevents mixing entries written in this process.
+// Each entry is written by one write call to a file opened with O_APPEND,
+// so entries from git hooks are not mixed either.
+var auditMutex sync.Mutex
+
+// writeAudit appends the entry to the audit log.
+// Failure of it is logged, but not stops the action.
+func writeAudit(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("could not open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("could not write audit log: %v", err)
+	}
+}
+
+// audit records an action requested by the user with the request.
+func audit(r *http.Request, user, action, repo, target string) {
+	writeAudit(auditEntry{Actor: user, IP: remoteIP(r), Action: action, Repo: repo, Target: target})
+}
+
+// readAudit returns entries matching with the filter, newest first.
+// Empty fields of the filter match with any value.
+// At most n entries are returned.
+func readAudit(filter auditEntry, n int) ([]auditEntry, error) {
+	f, err := os.Open(auditFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []auditEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]auditEntry, 0)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		var e auditEntry
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			log.Printf("invalid audit log line: %v", err)
+			continue
+		}
+		if filter.Actor != "" && filter.Actor != e.Actor {
+			continue
+		}
+		if filter.Action != "" && filter.Action != e.Action {
+			continue
+		}
+		if filter.Repo != "" && filter.Repo != e.Repo {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
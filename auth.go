@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks a password of a user.
+// It returns an error only when it could not check, like a server is down.
+type Authenticator interface {
+	Authenticate(name, passwd string) (bool, error)
+}
+
+// authenticator is chosen by -auth flag in initAuth.
+var authenticator Authenticator = localAuth{}
+
+// initAuth sets authenticator for the backend name.
+func initAuth(backend string) error {
+	switch backend {
+	case "local":
+		authenticator = localAuth{}
+	case "htpasswd":
+		if htpasswdFile == "" {
+			return errors.New("-htpasswd flag is needed for htpasswd authentication")
+		}
+		authenticator = htpasswdAuth{file: htpasswdFile}
+	case "ldap":
+		if ldapURL == "" || ldapDN == "" {
+			return errors.New("-ldap and -ldap-dn flags are needed for ldap authentication")
+		}
+		authenticator = ldapAuth{url: ldapURL, dn: ldapDN}
+	default:
+		return fmt.Errorf("unknown authentication backend: %v", backend)
+	}
+	return nil
+}
+
+// authenticate checks the user's password with the authenticator.
+// Disabled users are always rejected. A user authenticated by an external
+// backend is added to the user data at the first time,
+// so tokens, keys and disabling work for them like local users.
+func authenticate(name, passwd string) bool {
+	if !userNamePattern.MatchString(name) || userDisabled(name) {
+		return false
+	}
+	ok, err := authenticator.Authenticate(name, passwd)
+	if err != nil {
+		log.Printf("authentication error: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if _, local := authenticator.(localAuth); !local && !userExist(name) {
+		// the local password is never used, make it unguessable.
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			log.Print(err)
+			return false
+		}
+		err = addUser(name, hex.EncodeToString(b))
+		if err != nil {
+			log.Printf("could not add user %v: %v", name, err)
+			return false
+		}
+		log.Printf("user added by authentication: %v", name)
+		if name == firstAdmin && !hasAdmin() {
+			log.Printf("no admin user, making %v an admin as -admin flag", name)
+			err = setUserAdmin(name, true)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return true
+}
+
+// localAuth checks passwords in the user data.
+type localAuth struct{}
+
+func (localAuth) Authenticate(name, passwd string) (bool, error) {
+	return checkPassword(name, passwd), nil
+}
+
+// htpasswdAuth checks passwords in an Apache htpasswd file.
+// bcrypt, apr1 (md5) and sha1 hashes are supported.
+// The file is read for every authentication, so it could be edited with htpasswd anytime.
+type htpasswdAuth struct {
+	file string
+}
+
+func (a htpasswdAuth) Authenticate(name, passwd string) (bool, error) {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 || kv[0] != name {
+			continue
+		}
+		return htpasswdMatch(kv[1], passwd)
+	}
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	compareDummyHash(passwd)
+	return false, nil
+}
+
+func htpasswdMatch(hash, passwd string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil, nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		h := md5Crypt([]byte(passwd), []byte(salt), []byte("$apr1$"))
+		return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(passwd))
+		h := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1, nil
+	}
+	return false, errors.New("unsupported htpasswd hash, please use bcrypt, apr1 or sha1")
+}
+
+// md5Crypt is the md5 based crypt used by Apache (with "$apr1$" magic).
+func md5Crypt(passwd, salt, magic []byte) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alt := md5.New()
+	alt.Write(passwd)
+	alt.Write(salt)
+	alt.Write(passwd)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(passwd)
+	h.Write(magic)
+	h.Write(salt)
+	for i := len(passwd); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(passwd); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(passwd[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(passwd)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(passwd)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(passwd)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := make([]byte, 0, 22)
+	enc := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		enc(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	enc(uint(sum[11]), 2)
+	return string(magic) + string(salt) + "$" + string(out)
+}
+
+// ldapAuth checks passwords by simple bind to an LDAP server.
+// url is like "ldap://host:389" or "ldaps://host:636",
+// and dn is a format of the user's dn like "uid=%s,ou=people,dc=example,dc=com".
+type ldapAuth struct {
+	url string
+	dn  string
+}
+
+const ldapTimeout = 10 * time.Second
+
+// BER tags used in LDAP bind.
+const (
+	berInteger      = 0x02
+	berOctetString  = 0x04
+	berEnumerated   = 0x0a
+	berSequence     = 0x30
+	ldapBindRequest = 0x60
+	ldapBindResult  = 0x61
+	ldapUnbind      = 0x42
+	ldapSimpleAuth  = 0x80
+)
+
+// LDAP result codes.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+func (a ldapAuth) Authenticate(name, passwd string) (bool, error) {
+	// bind with empty password is an anonymous bind, which always succeeds.
+	if passwd == "" {
+		return false, nil
+	}
+	u, err := url.Parse(a.url)
+	if err != nil {
+		return false, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var c net.Conn
+	d := &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldap":
+		c, err = d.Dial("tcp", host)
+	case "ldaps":
+		c, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return false, fmt.Errorf("unknown ldap scheme: %v", u.Scheme)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ldapTimeout))
+
+	dn := fmt.Sprintf(a.dn, ldapEscapeDN(name))
+	// LDAPv3 bind request as message 1, then unbind as message 2.
+	bind := berTLV(ldapBindRequest, concat(
+		berInt(3),
+		berTLV(berOctetString, []byte(dn)),
+		berTLV(ldapSimpleAuth, []byte(passwd)),
+	))
+	_, err = c.Write(berTLV(berSequence, concat(berInt(1), bind)))
+	if err != nil {
+		return false, err
+	}
+	code, err := readBindResponse(bufio.NewReader(c))
+	if err != nil {
+		return false, err
+	}
+	c.Write(berTLV(berSequence, concat(berInt(2), berTLV(ldapUnbind, nil))))
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("ldap bind of %v failed with result code %v", dn, code)
+}
+
+// ldapEscapeDN escapes special characters of an attribute value in a dn (RFC 4514).
+// User names are limited by userNamePattern, but it should not rely on it.
+func ldapEscapeDN(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b = append(b, `\00`...)
+			continue
+		case strings.IndexByte(`\,+"<>;=`, c) >= 0,
+			i == 0 && (c == '#' || c == ' '),
+			i == len(s)-1 && c == ' ':
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// readBindResponse reads an LDAP message of bind response, and returns its result code.
+func readBindResponse(r *bufio.Reader) (int, error) {
+	tag, msg, err := readBER(r)
+	if err != nil {
+		return -1, err
+	}
+	if tag != berSequence {
+		return -1, fmt.Errorf("unexpected ldap message tag: %x", tag)
+	}
+	mr := bufio.NewReader(strings.NewReader(string(msg)))
+	tag, _, err = readBER(mr)
+	if err != nil || tag != berInteger {
+		return -1, errors.New("invalid ldap message id")
+	}
+	tag, op, err := readBER(mr)
+	if err != nil || tag != ldapBindResult {
+		return -1, fmt.Errorf("unexpected ldap response tag: %x", tag)
+	}
+	tag, rc, err := readBER(bufio.NewReader(strings.NewReader(string(op))))
+	if err != nil || tag != berEnumerated || len(rc) == 0 {
+		return -1, errors.New("invalid ldap result code")
+	}
+	code := 0
+	for _, b := range rc {
+		code = code<<8 | int(b)
+	}
+	return code, nil
+}
+
+// readBER reads a BER encoded value with a single byte tag.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		nb := int(l & 0x7f)
+		if nb == 0 || nb > 4 {
+			return 0, nil, errors.New("unsupported ber length")
+		}
+		n = 0
+		for i := 0; i < nb; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("too long ber value")
+	}
+	v := make([]byte, n)
+	_, err = io.ReadFull(r, v)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tag, v, nil
+}
+
+// berTLV encodes the value with the tag and its length.
+func berTLV(tag byte, v []byte) []byte {
+	b := []byte{tag}
+	n := len(v)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, v...)
+}
+
+// berInt encodes a small non-negative integer.
+func berInt(n int) []byte {
+	v := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		v = append([]byte{byte(n)}, v...)
+	}
+	if v[0]&0x80 != 0 {
+		v = append([]byte{0}, v...)
+	}
+	return berTLV(berInteger, v)
+}
+
+func concat(bs ...[]byte) []byte {
+	c := make([]byte, 0)
+	for _, b := range bs {
+		c = append(c, b...)
+	}
+	return c
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeLDAP is a minimal LDAP server, which only answers simple bind requests.
+// It accepts the bind when the dn and password match, and records the dns it got.
+type fakeLDAP struct {
+	ln     net.Listener
+	dn     string
+	passwd string
+	got    chan string
+}
+
+func newFakeLDAP(t *testing.T, dn, passwd string) *fakeLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeLDAP{ln: ln, dn: dn, passwd: passwd, got: make(chan string, 10)}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeLDAP) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *fakeLDAP) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *fakeLDAP) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	_, msg, err := readBER(r)
+	if err != nil {
+		return
+	}
+	mr := bufio.NewReader(strings.NewReader(string(msg)))
+	readBER(mr) // message id
+	tag, op, err := readBER(mr)
+	if err != nil || tag != ldapBindRequest {
+		return
+	}
+	or := bufio.NewReader(strings.NewReader(string(op)))
+	readBER(or) // version
+	_, dn, _ := readBER(or)
+	_, passwd, _ := readBER(or)
+	s.got <- string(dn)
+
+	code := ldapInvalidCredentials
+	if string(dn) == s.dn && string(passwd) == s.passwd {
+		code = ldapSuccess
+	}
+	res := berTLV(ldapBindResult, concat(
+		berTLV(berEnumerated, []byte{byte(code)}),
+		berTLV(berOctetString, nil),
+		berTLV(berOctetString, nil),
+	))
+	c.Write(berTLV(berSequence, concat(berInt(1), res)))
+	// wait the unbind.
+	readBER(r)
+}
+
+func TestLDAPAuth(t *testing.T) {
+	s := newFakeLDAP(t, "uid=alice,ou=people,dc=example,dc=com", "secret")
+	a := ldapAuth{url: s.url(), dn: "uid=%s,ou=people,dc=example,dc=com"}
+
+	ok, err := a.Authenticate("alice", "secret")
+	if err != nil || !ok {
+		t.Fatalf("bind with the right password: got %v, %v", ok, err)
+	}
+	ok, err = a.Authenticate("alice", "wrong")
+	if err != nil || ok {
+		t.Fatalf("bind with a bad password: got %v, %v", ok, err)
+	}
+	if dn := <-s.got; dn != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("unexpected dn: %v", dn)
+	}
+}
+
+func TestLDAPAuthEmptyPassword(t *testing.T) {
+	s := newFakeLDAP(t, "uid=alice,ou=people", "")
+	a := ldapAuth{url: s.url(), dn: "uid=%s,ou=people"}
+	// it would be an anonymous bind, should not be sent.
+	ok, err := a.Authenticate("alice", "")
+	if err != nil || ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	select {
+	case dn := <-s.got:
+		t.Fatalf("bind is sent: %v", dn)
+	default:
+	}
+}
+
+func TestLDAPAuthEscapeDN(t *testing.T) {
+	s := newFakeLDAP(t, `uid=a\,uid\=admin\+b,ou=people`, "secret")
+	a := ldapAuth{url: s.url(), dn: "uid=%s,ou=people"}
+	ok, err := a.Authenticate("a,uid=admin+b", "secret")
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if dn := <-s.got; dn != `uid=a\,uid\=admin\+b,ou=people` {
+		t.Fatalf("dn is not escaped: %v", dn)
+	}
+}
+
+func TestLDAPEscapeDN(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"alice", "alice"},
+		{"a,b", `a\,b`},
+		{`a\b`, `a\\b`},
+		{`"<a>;"`, `\"\<a\>\;\"`},
+		{"#a", `\#a`},
+		{"a#", "a#"},
+		{" a ", `\ a\ `},
+		{"a\x00", `a\00`},
+	}
+	for _, c := range cases {
+		if got := ldapEscapeDN(c.in); got != c.want {
+			t.Errorf("ldapEscapeDN(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -3,44 +3,89 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"path"
+	"path/filepath"
+	"time"
 )
 
 var (
 	ipAddr     string
 	repoRoot   string
 	reviewRoot string
-	password   string
+	userRoot   string
+	accessFile string
+	sshAddr    string
+	auditFile  string
+
+	tlsCert       string
+	tlsKey        string
+	tlsSelfSigned bool
+	httpRedirect  string
+
+	authBackend  string
+	htpasswdFile string
+	ldapURL      string
+	ldapDN       string
+	firstAdmin   string
+	baseURL      string
 )
 
 func init() {
 	flag.StringVar(&ipAddr, "ip", ":8080", "ip address")
 	flag.StringVar(&repoRoot, "repo", "repo", "repository root directory")
 	flag.StringVar(&reviewRoot, "review", "review", "review data root directory")
+	flag.StringVar(&userRoot, "user", "user", "user data root directory")
+	flag.StringVar(&accessFile, "access", "access", "repository access control file")
+	flag.StringVar(&sshAddr, "ssh", "", "ssh address, ssh is not served if empty")
+	flag.StringVar(&auditFile, "audit", "audit.log", "audit log file")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file, serve https if given")
+	flag.StringVar(&tlsKey, "tls-key", "", "certificate key file")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "generate self-signed certificate if the certificate files not exist")
+	flag.StringVar(&authBackend, "auth", "local", "authentication backend: local, htpasswd or ldap")
+	flag.StringVar(&htpasswdFile, "htpasswd", "", "htpasswd file for htpasswd authentication")
+	flag.StringVar(&ldapURL, "ldap", "", "ldap server url for ldap authentication (ex. ldap://localhost:389)")
+	flag.StringVar(&ldapDN, "ldap-dn", "", "dn format of users for ldap authentication (ex. uid=%s,ou=people,dc=example,dc=com)")
+	flag.StringVar(&firstAdmin, "admin", "", "user made an admin when there is no admin, for authentication backends other than local")
+	flag.StringVar(&baseURL, "url", "", "url of web pages (ex. https://git.example.com), shown to ssh clients")
+	flag.StringVar(&httpRedirect, "http-redirect", "", "http address redirecting to https, not served if empty")
+	flag.IntVar(&maintenancePushes, "maintenance-pushes", 100, "maintain a repository after the number of pushes, 0 to disable")
+	flag.DurationVar(&maintenanceInterval, "maintenance-interval", 24*time.Hour, "maintain a repository after the interval, 0 to disable")
+	flag.DurationVar(&mirrorInterval, "mirror-interval", time.Hour, "interval to sync mirror repositories")
+}
 
-	b, err := ioutil.ReadFile("password")
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("please make 'password' file with your password.")
-			os.Exit(1)
-		} else {
-			fmt.Printf("open password error: %v\n", err)
+func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "hook" {
+		var args []string
+		if flag.NArg() > 3 {
+			args = flag.Args()[3:]
+		}
+		err := runHook(flag.Arg(1), flag.Arg(2), args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		return
 	}
-	password = strings.Split(string(b), "\n")[0]
-	if password == "" {
-		fmt.Println("password file should not empty (need password).")
+
+	err := initAuth(authBackend)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-}
-
-func main() {
-	flag.Parse()
+	err = initUsers()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = initSessionKey()
+	if err != nil {
+		log.Fatalf("could not load session key: %v", err)
+	}
 
 	grps, err := dirScan(repoRoot)
 	if err != nil {
@@ -49,9 +94,45 @@ func main() {
 	log.Print("initial scan result")
 	for _, g := range grps {
 		log.Print(g)
+		for _, r := range g.Repos {
+			err := installHooks(path.Join(g.Name, r.Name))
+			if err != nil {
+				log.Fatalf("could not install hooks: %v", err)
+			}
+			err = updateServerInfo(filepath.Join(repoRoot, g.Name, r.Name))
+			if err != nil {
+				log.Print(err)
+			}
+			err = applyGitSettings(path.Join(g.Name, r.Name))
+			if err != nil {
+				log.Fatalf("could not apply git settings: %v", err)
+			}
+		}
+	}
+
+	go runMaintenance()
+	go runMirrors()
+
+	if sshAddr != "" {
+		go func() {
+			log.Fatal(serveSSH(sshAddr))
+		}()
 	}
 
 	http.HandleFunc("/", rootHandler)
-	log.Printf("binding to %v", ipAddr)
-	log.Fatal(http.ListenAndServe(ipAddr, nil))
+	if tlsCert == "" {
+		log.Printf("binding to %v", ipAddr)
+		log.Fatal(http.ListenAndServe(ipAddr, nil))
+	}
+	if tlsKey == "" {
+		log.Fatal("-tls-key should be given with -tls-cert")
+	}
+	if httpRedirect != "" {
+		go func() {
+			log.Printf("redirecting %v to https", httpRedirect)
+			log.Fatal(http.ListenAndServe(httpRedirect, http.HandlerFunc(redirectToHTTPS)))
+		}()
+	}
+	log.Printf("binding to %v (https)", ipAddr)
+	log.Fatal(listenAndServeTLS(ipAddr, tlsCert, tlsKey, tlsSelfSigned))
 }
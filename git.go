@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -33,8 +34,8 @@ func (b *Blob) String() string {
 }
 
 // gitDir checks whether the _d_ is git directory, or not.
-// if not found the path, it will return false.
-// any other error makes it fatal.
+// if not found the path, or it is not inside of a git directory,
+// it will return false. any other error makes it fatal.
 func gitDir(d string) bool {
 	cmd := exec.Command("git", "rev-parse", "--git-dir")
 	cmd.Dir = d
@@ -43,11 +44,86 @@ func gitDir(d string) bool {
 		if os.IsNotExist(err) {
 			return false
 		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return false
+		}
 		log.Fatalf("(%v) %s", err, out)
 	}
 	return string(out) == ".\n"
 }
 
+// gitConfig returns config value of the key in git directory _d_.
+// It returns empty string if the key is not set.
+func gitConfig(d, key string) string {
+	cmd := exec.Command("git", "config", "--get", key)
+	cmd.Dir = d
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+func setGitConfig(d, key, value string) error {
+	cmd := exec.Command("git", "config", key, value)
+	cmd.Dir = d
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
+// updateServerInfo updates info/refs and objects/info/packs of the git directory,
+// which are read by dumb http clients.
+// git does not care transfer.hideRefs for info/refs, so hidden refs are removed from it.
+func updateServerInfo(d string) error {
+	cmd := exec.Command("git", "update-server-info")
+	cmd.Dir = d
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+	}
+	f := filepath.Join(d, "info", "refs")
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	refs := ""
+	for _, l := range strings.SplitAfter(string(b), "\n") {
+		if strings.Contains(l, "\trefs/coldmine/") {
+			continue
+		}
+		refs += l
+	}
+	if refs == string(b) {
+		return nil
+	}
+	// replace it at once, clients may be reading it.
+	tmp := f + ".coldmine"
+	err = ioutil.WriteFile(tmp, []byte(refs), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+// unsetGitConfig removes the key from config of git directory _d_.
+// It is not an error when the key is not set.
+func unsetGitConfig(d, key string) error {
+	cmd := exec.Command("git", "config", "--unset-all", key)
+	cmd.Dir = d
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// exit code 5 means the key is not set.
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 5 {
+			return nil
+		}
+		return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
 func lastUpdate(repo string) string {
 	cmd := exec.Command("git", "log", "--pretty=format:%ar", "-1")
 	cmd.Dir = repo
@@ -167,7 +243,7 @@ func initialCommitID(repo string) string {
 	cmd.Dir = filepath.Join(repoRoot, repo)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Print("%v: (%v) %s", cmd, err, out)
+		log.Printf("%v: (%v) %s", cmd, err, out)
 		return ""
 	}
 	return strings.Split(string(out), "\n")[0]
@@ -178,7 +254,7 @@ func currentBranch(repo string) string {
 	cmd.Dir = filepath.Join(repoRoot, repo)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Print("%v: (%v) %s", cmd, err, out)
+		log.Printf("%v: (%v) %s", cmd, err, out)
 		return ""
 	}
 	return strings.TrimSuffix(string(out), "\n")
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// gitSetting is a git config of bare repositories, which coldmine manages.
+// Admins of a repository could change them in the settings page.
+type gitSetting struct {
+	Key string
+	// Default is applied when the key is not set in the repo.
+	Default bool
+	Desc    string
+}
+
+// gitSettings are settings for fetching, mostly for partial and shallow clones.
+// Shallow fetches (--depth, --shallow-since) are always allowed by git.
+var gitSettings = []gitSetting{
+	{"uploadpack.allowFilter", true, "partial clone (ex. --filter=blob:none)"},
+	{"uploadpack.allowAnySHA1InWant", true, "fetch any object by its id, which partial clones need for missing objects"},
+	{"uploadpack.allowReachableSHA1InWant", false, "fetch commits reachable from refs by their ids"},
+	{"uploadpack.allowTipSHA1InWant", false, "fetch hidden ref tips by their ids"},
+	{"uploadpack.allowRefInWant", false, "fetch refs by their names (protocol v2)"},
+}
+
+// repoGitSetting is a git setting and its value in a repository.
+type repoGitSetting struct {
+	gitSetting
+	Value bool
+}
+
+// applyGitSettings sets the defaults of git settings not set in the repo.
+// It is called when a repo is added, and for every repo when coldmine starts,
+// so repos get new settings too.
+//
+// Settings turned off by default are not written, as git turns them off
+// when they are not set. Also an explicit false could cancel other settings,
+// ex. allowTipSHA1InWant = false cancels a part of allowAnySHA1InWant.
+func applyGitSettings(repo string) error {
+	d := filepath.Join(repoRoot, repo)
+	for _, s := range gitSettings {
+		if !s.Default || gitConfig(d, s.Key) != "" {
+			continue
+		}
+		err := setGitConfig(d, s.Key, fmt.Sprint(s.Default))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func repoGitSettings(repo string) []repoGitSetting {
+	d := filepath.Join(repoRoot, repo)
+	settings := make([]repoGitSetting, 0, len(gitSettings))
+	for _, s := range gitSettings {
+		v := s.Default
+		switch gitConfig(d, s.Key) {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		}
+		settings = append(settings, repoGitSetting{gitSetting: s, Value: v})
+	}
+	return settings
+}
+
+// setRepoGitSettings sets values of git settings in the repo.
+// Keys not managed by coldmine are not allowed.
+func setRepoGitSettings(repo string, values map[string]bool) error {
+	d := filepath.Join(repoRoot, repo)
+	known := make(map[string]bool)
+	for _, s := range gitSettings {
+		known[s.Key] = true
+	}
+	for k := range values {
+		if !known[k] {
+			return fmt.Errorf("unknown git setting: %v", k)
+		}
+	}
+	for _, s := range gitSettings {
+		v, ok := values[s.Key]
+		if !ok {
+			continue
+		}
+		var err error
+		if !v && !s.Default {
+			err = unsetGitConfig(d, s.Key)
+		} else {
+			err = setGitConfig(d, s.Key, fmt.Sprint(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
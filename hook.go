@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// zeroID is the object id git uses for a ref which not exist.
+const zeroID = "0000000000000000000000000000000000000000"
+
+// refUpdate is a line of pre-receive or post-receive hook input.
+type refUpdate struct {
+	Old string
+	New string
+	Ref string
+}
+
+// installHooks writes git hooks of the repo, and git config they need.
+// It is called when a repo is added, and for every repo when coldmine starts,
+// so the hooks always point current coldmine executable.
+func installHooks(repo string) error {
+	d := filepath.Join(repoRoot, repo)
+	for _, name := range []string{"pre-receive", "update", "proc-receive", "post-receive"} {
+		h, err := goHook(name)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(d, "hooks", name), []byte(h), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	// push options are passed to proc-receive hook.
+	err := setGitConfig(d, "receive.advertisePushOptions", "true")
+	if err != nil {
+		return err
+	}
+	// review refs are not fetched or pushed by clients.
+	err = setGitConfig(d, "transfer.hideRefs", "refs/coldmine/")
+	if err != nil {
+		return err
+	}
+	err = unsetGitConfig(d, "receive.procReceiveRefs")
+	if err != nil {
+		return err
+	}
+	for _, ref := range procReceiveRefs {
+		cmd := exec.Command("git", "config", "--add", "receive.procReceiveRefs", ref)
+		cmd.Dir = d
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+		}
+	}
+	return nil
+}
+
+// goHook returns a hook script which runs coldmine itself as the hook.
+// The script moves to the coldmine working directory and passes same flags
+// with the server, then coldmine gets the repository path as an argument.
+func goHook(name string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	args := []string{shellQuote(exe)}
+	flag.Visit(func(f *flag.Flag) {
+		args = append(args, shellQuote("-"+f.Name+"="+f.Value.String()))
+	})
+	args = append(args, "hook", name, `"$d"`, `"$@"`)
+	return fmt.Sprintf("#!/bin/sh\nd=$(pwd)\ncd %v && exec %v\n", shellQuote(wd), strings.Join(args, " ")), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runHook runs the git hook, when coldmine is called as "coldmine hook <name> <dir> [args...]".
+// Messages written to stderr will shown to the git client.
+func runHook(name, dir string, args []string) error {
+	if name == "update" {
+		// update hook gets a ref update as arguments, not stdin.
+		if len(args) != 3 {
+			return fmt.Errorf("invalid update hook arguments: %v", args)
+		}
+		return checkPushPolicy(dir, refUpdate{Ref: args[0], Old: args[1], New: args[2]})
+	}
+	if name == "proc-receive" {
+		return procReceive(dir, os.Stdin, os.Stdout)
+	}
+	updates, err := readRefUpdates(os.Stdin)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "pre-receive":
+		if gitConfig(dir, "coldmine.mirror") != "" {
+			return fmt.Errorf("coldmine: %v is a mirror, it could not be pushed", hookRepo(dir))
+		}
+		return checkProtectedBranches(dir, updates)
+	case "post-receive":
+		auditPush(dir, updates)
+		if gitConfig(dir, "coldmine.dumbHTTP") != "false" {
+			err := updateServerInfo(dir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		return syncReviewRepo(dir, updates)
+	}
+	return fmt.Errorf("unknown hook: %v", name)
+}
+
+// hookRepo returns repository name of the git directory.
+func hookRepo(dir string) string {
+	root, err := filepath.Abs(repoRoot)
+	if err != nil {
+		return dir
+	}
+	repo, err := filepath.Rel(root, dir)
+	if err != nil {
+		return dir
+	}
+	return filepath.ToSlash(repo)
+}
+
+// auditPush records the push to the audit log.
+func auditPush(dir string, updates []refUpdate) {
+	refs := make([]auditRef, 0, len(updates))
+	for _, u := range updates {
+		refs = append(refs, auditRef{Ref: u.Ref, Old: u.Old, New: u.New})
+	}
+	e := auditEntry{
+		Actor:  os.Getenv("COLDMINE_USER"),
+		IP:     os.Getenv("COLDMINE_REMOTE_ADDR"),
+		Action: "push",
+		Repo:   hookRepo(dir),
+		Refs:   refs,
+	}
+	if n := os.Getenv("COLDMINE_REVIEW"); n != "" {
+		e.Target = "review " + n
+	}
+	writeAudit(e)
+}
+
+// syncReviewRepo pulls pushed branches to the review repository.
+func syncReviewRepo(dir string, updates []refUpdate) error {
+	rd := dir + ".r"
+	// git commands should not see the environment variables for the bare repo.
+	cmd := exec.Command("git", "rev-parse", "--local-env-vars")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	local := make(map[string]bool)
+	for _, v := range strings.Fields(string(out)) {
+		local[v] = true
+	}
+	env := make([]string, 0)
+	for _, kv := range os.Environ() {
+		if !local[strings.SplitN(kv, "=", 2)[0]] {
+			env = append(env, kv)
+		}
+	}
+
+	for _, u := range updates {
+		if u.New == zeroID {
+			continue
+		}
+		var commands []*exec.Cmd
+		switch {
+		case strings.HasPrefix(u.Ref, "refs/coldmine/review/"):
+			// hidden refs should be shown to fetch them.
+			// config given by "git -c" is not passed to upload-pack of local repository.
+			commands = []*exec.Cmd{
+				exec.Command("git", "fetch", "--upload-pack=git -c uploadpack.hideRefs=!refs/coldmine/ upload-pack", "origin", "+"+u.Ref+":"+u.Ref),
+			}
+		case strings.HasPrefix(u.Ref, "refs/heads/"):
+			b := strings.TrimPrefix(u.Ref, "refs/heads/")
+			commands = []*exec.Cmd{
+				exec.Command("git", "fetch", "origin", "--update-head-ok", b),
+				exec.Command("git", "branch", "-f", b, "origin/"+b),
+			}
+			if b == "master" {
+				commands = []*exec.Cmd{exec.Command("git", "pull", "origin", "master")}
+			}
+		default:
+			continue
+		}
+		for _, cmd := range commands {
+			cmd.Dir = rd
+			cmd.Env = env
+			out, err := cmd.CombinedOutput()
+			// show the output to the client like the shell hook did.
+			os.Stderr.Write(out)
+			if err != nil {
+				return fmt.Errorf("%v: %v", cmd.Args, err)
+			}
+		}
+	}
+	return nil
+}
+
+func readRefUpdates(r io.Reader) ([]refUpdate, error) {
+	updates := make([]refUpdate, 0)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.Fields(s.Text())
+		if len(l) != 3 {
+			return nil, fmt.Errorf("invalid hook input: %v", s.Text())
+		}
+		updates = append(updates, refUpdate{Old: l[0], New: l[1], Ref: l[2]})
+	}
+	return updates, s.Err()
+}
+
+// hookEnv returns environment variables for git commands which could run hooks.
+// It let the hooks know who is running them from where.
+func hookEnv(user, ip string) []string {
+	return append(os.Environ(),
+		"COLDMINE_USER="+user,
+		"COLDMINE_GROUPS="+strings.Join(userGroups(user), ","),
+		"COLDMINE_REMOTE_ADDR="+ip,
+	)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -11,37 +13,59 @@ import (
 type Service struct {
 	method      string
 	pathPattern *regexp.Regexp
+	perm        perm
 	serv        func(w http.ResponseWriter, r *http.Request, repo, pth string)
 }
 
-var services = []Service{
-	// git service
-	{"GET", regexp.MustCompile("^/HEAD$"), getHead},
-	{"GET", regexp.MustCompile("^/info/refs$"), getInfoRefs},
-	{"GET", regexp.MustCompile("^/objects/info/alternates$"), getTextFile},
-	{"GET", regexp.MustCompile("^/objects/info/http-alternates$"), getTextFile},
-	{"GET", regexp.MustCompile("^/objects/info/packs$"), getInfoPacks},
-	{"GET", regexp.MustCompile("^/objects/[0-9a-f]{2}/[0-9a-f]{38}$"), getLooseObject},
-	{"GET", regexp.MustCompile("^/objects/pack/pack-[0-9a-f]{40}\\.pack$"), getPackFile},
-	{"GET", regexp.MustCompile("^/objects/pack/pack-[0-9a-f]{40}\\.idx$"), getIdxFile},
-	{"POST", regexp.MustCompile("^/git-upload-pack$"), serviceUpload},
-	{"POST", regexp.MustCompile("^/git-receive-pack$"), serviceReceive},
+// gitServices authenticate users with basic auth.
+var gitServices = []Service{
+	{"GET", regexp.MustCompile("^/HEAD$"), permRead, dumbHTTP(getHead)},
+	{"GET", regexp.MustCompile("^/info/refs$"), permRead, getInfoRefs},
+	{"GET", regexp.MustCompile("^/objects/info/alternates$"), permRead, dumbHTTP(getTextFile)},
+	{"GET", regexp.MustCompile("^/objects/info/http-alternates$"), permRead, dumbHTTP(getTextFile)},
+	{"GET", regexp.MustCompile("^/objects/info/packs$"), permRead, dumbHTTP(getInfoPacks)},
+	{"GET", regexp.MustCompile("^/objects/[0-9a-f]{2}/[0-9a-f]{38}$"), permRead, dumbHTTP(getLooseObject)},
+	{"GET", regexp.MustCompile("^/objects/pack/pack-[0-9a-f]{40}\\.pack$"), permRead, dumbHTTP(getPackFile)},
+	{"GET", regexp.MustCompile("^/objects/pack/pack-[0-9a-f]{40}\\.idx$"), permRead, dumbHTTP(getIdxFile)},
+	{"POST", regexp.MustCompile("^/git-upload-pack$"), permRead, serviceUpload},
+	{"POST", regexp.MustCompile("^/git-receive-pack$"), permWrite, serviceReceive},
+	{"POST", regexp.MustCompile("^/info/lfs/objects/batch$"), permRead, serveLFSBatch},
+	{"GET", regexp.MustCompile("^/info/lfs/objects/[0-9a-f]{64}$"), permRead, getLFSObject},
+	{"PUT", regexp.MustCompile("^/info/lfs/objects/[0-9a-f]{64}$"), permWrite, putLFSObject},
+}
 
-	// web service
-	{"GET", regexp.MustCompile("^/$"), serveOverview},
-	{"GET", regexp.MustCompile("^/tree/"), serveTree},
-	{"GET", regexp.MustCompile("^/blob/"), serveBlob},
-	{"GET", regexp.MustCompile("^/commit/"), serveCommit},
-	{"GET", regexp.MustCompile("^/log/"), serveLog},
-	{"POST", regexp.MustCompile("^/reviews/action$"), serveReviewsAction},
-	{"GET", regexp.MustCompile("^/reviews/$"), serveReviews},
-	{"POST", regexp.MustCompile("^/review/action$"), serveReviewAction},
-	{"GET", regexp.MustCompile("^/review/"), serveReview},
+// webServices authenticate users with session cookie.
+// Actions check the user's permission by themselves,
+// as they also need to check csrf token of the form.
+var webServices = []Service{
+	{"GET", regexp.MustCompile("^/$"), permRead, serveOverview},
+	{"GET", regexp.MustCompile("^/tree/"), permRead, serveTree},
+	{"GET", regexp.MustCompile("^/blob/"), permRead, serveBlob},
+	{"GET", regexp.MustCompile("^/commit/"), permRead, serveCommit},
+	{"GET", regexp.MustCompile("^/log/"), permRead, serveLog},
+	{"GET", regexp.MustCompile("^/lfs/[0-9a-f]{64}$"), permRead, getLFSObject},
+	{"GET", regexp.MustCompile("^/archive/.+"), permRead, serveArchive},
+	{"POST", regexp.MustCompile("^/reviews/action$"), permRead, serveReviewsAction},
+	{"GET", regexp.MustCompile("^/reviews/$"), permRead, serveReviews},
+	{"POST", regexp.MustCompile("^/review/action$"), permRead, serveReviewAction},
+	{"GET", regexp.MustCompile("^/review/"), permRead, serveReview},
+	{"POST", regexp.MustCompile("^/settings/action$"), permRead, serveSettingsAction},
+	{"GET", regexp.MustCompile("^/settings/$"), permAdmin, serveSettings},
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	log.Print(r.URL.Path)
 
+	// admins should enroll two-factor authentication before doing anything.
+	if u := sessionUser(r); u != "" && userAdmin(u) && !totpEnabled(u) {
+		switch r.URL.Path {
+		case "/2fa/", "/2fa/action", "/logout":
+		default:
+			http.Redirect(w, r, "/2fa/", http.StatusSeeOther)
+			return
+		}
+	}
+
 	switch r.URL.Path {
 	case "/":
 		serveRoot(w, r)
@@ -49,6 +73,42 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	case "/action":
 		serveRootAction(w, r)
 		return
+	case "/users/":
+		serveUsers(w, r)
+		return
+	case "/users/action":
+		serveUsersAction(w, r)
+		return
+	case "/login":
+		serveLogin(w, r)
+		return
+	case "/logout":
+		serveLogout(w, r)
+		return
+	case "/tokens/":
+		serveTokens(w, r)
+		return
+	case "/tokens/action":
+		serveTokensAction(w, r)
+		return
+	case "/keys/":
+		serveKeys(w, r)
+		return
+	case "/keys/action":
+		serveKeysAction(w, r)
+		return
+	case "/audit/":
+		serveAudit(w, r)
+		return
+	case "/maintenance/":
+		serveMaintenance(w, r)
+		return
+	case "/2fa/":
+		serveTwoFactor(w, r)
+		return
+	case "/2fa/action":
+		serveTwoFactorAction(w, r)
+		return
 	}
 
 	repo, subpath := splitURLPath(r.URL.Path)
@@ -57,25 +117,100 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, s := range services {
-		if s.pathPattern.FindString(subpath) == "" {
-			continue
+	s, found := matchService(gitServices, r.Method, subpath)
+	web := false
+	if !found {
+		s, found = matchService(webServices, r.Method, subpath)
+		web = true
+	}
+	if !found {
+		if strings.HasPrefix(subpath, "/info/lfs/") {
+			// git-lfs takes 404 as the api is not supported, like locks.
+			lfsWriteError(w, http.StatusNotFound, "not supported")
+			return
 		}
-		if s.method != r.Method {
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if s == nil {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	need := s.perm
+	if subpath == "/info/refs" && r.URL.Query().Get("service") == "git-receive-pack" {
+		need = permWrite
+	}
+	var user string
+	var p perm
+	if web {
+		user = sessionUser(r)
+		p = repoPerm(user, repo)
+	} else {
+		var tok *accessToken
+		user, tok, _ = checkAuth(r)
+		p = repoPerm(user, repo)
+		if tok != nil {
+			p = tok.limit(repo, p)
+		}
+		// services should not authenticate again, see requestAuth.
+		r = r.WithContext(context.WithValue(r.Context(), authKey{}, authInfo{user, tok}))
+	}
+	if p < need {
+		if user == "" && web {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if user == "" {
+			requireAuth(w)
 			return
 		}
-		s.serv(w, r, repo, filepath.Join(repoRoot, r.URL.Path[1:]))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
+	s.serv(w, r, repo, filepath.Join(repoRoot, repo, subpath))
+}
+
+type authKey struct{}
+
+// authInfo is the user authenticated by basic auth and its access token if used.
+type authInfo struct {
+	user string
+	tok  *accessToken
+}
 
-	w.WriteHeader(http.StatusForbidden)
+// requestAuth returns the user and the token authenticated for a git service request.
+// The user is empty if not authenticated.
+func requestAuth(r *http.Request) (string, *accessToken) {
+	a, _ := r.Context().Value(authKey{}).(authInfo)
+	return a.user, a.tok
+}
+
+// matchService finds a service its method and path pattern matches with the request.
+// found reports whether any path pattern matches, even if the method does not.
+func matchService(services []Service, method, subpath string) (s *Service, found bool) {
+	for i, s := range services {
+		if s.pathPattern.FindString(subpath) != "" {
+			found = true
+			if s.method == method {
+				return &services[i], true
+			}
+		}
+	}
+	return nil, found
+}
+
+// requireAuth asks basic authentication to the client.
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="COLDMINE"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("401 Unathorized\n"))
 }
 
 // splitURLPath split url path to repo, subpath.
 // if the url not contains repo path,
 // it will return "" both repo and subpath.
 // root path "/" will trimmed if it exist.
+// repo could have ".git" suffix, like git-lfs adds to the remote url.
 func splitURLPath(p string) (string, string) {
 	if strings.HasPrefix(p, "/") {
 		p = p[1:]
@@ -84,16 +219,17 @@ func splitURLPath(p string) (string, string) {
 	if len(pp) < 1 {
 		return "", ""
 	}
-	repo := pp[0]
-	if gitDir(filepath.Join(repoRoot, repo)) {
-		return repo, strings.TrimPrefix(p, repo)
-	}
-	if len(pp) < 2 {
-		return "", ""
-	}
-	grpRepo := strings.Join(pp[0:2], "/")
-	if gitDir(filepath.Join(repoRoot, grpRepo)) {
-		return grpRepo, strings.TrimPrefix(p, grpRepo)
+	for n := 1; n <= 2 && n <= len(pp); n++ {
+		seg := strings.Join(pp[0:n], "/")
+		subpath := strings.TrimPrefix(p, seg)
+		repo := seg
+		if !gitDir(filepath.Join(repoRoot, repo)) {
+			repo = strings.TrimSuffix(seg, ".git")
+			if repo == seg || !gitDir(filepath.Join(repoRoot, repo)) {
+				continue
+			}
+		}
+		return repo, subpath
 	}
 	return "", ""
 }
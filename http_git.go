@@ -1,8 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,7 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -30,7 +31,9 @@ func getInfoRefs(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		if s == "git-receive-pack" {
 			args = []string{"receive-pack", "--stateless-rpc", "--advertise-refs", filepath.Join(repoRoot, repo)}
 		}
-		out, err := exec.Command("git", args...).CombinedOutput()
+		cmd := exec.Command("git", args...)
+		cmd.Env = gitEnv(r, "")
+		out, err := cmd.CombinedOutput()
 		if err != nil {
 			log.Printf("(%v) %s", err, out)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -38,35 +41,89 @@ func getInfoRefs(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		}
 		headerNoCache(w)
 		w.Header().Set("Content-Type", "application/x-"+s+"-advertisement")
-		p, err := packetLine("# service=" + s + "\n")
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		// protocol v2 starts with capability advertisement of git, without the service line.
+		if s != "git-upload-pack" || !protocolV2(r) {
+			p := newPktWriter(w)
+			p.writeLine("# service=%v", s)
+			p.flush()
 		}
-		w.Write([]byte(p))
-		w.Write([]byte("0000")) // flushing
 		w.Write(out)
 	} else {
 		// dumb protocol
-		err := exec.Command("git", "update-server-info").Run()
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if !repoDumbHTTP(repo) {
+			http.Error(w, "dumb http protocol is disabled", http.StatusForbidden)
 			return
 		}
+		// server info is updated after every push, but it may not exist for an old repo.
+		if _, err := os.Stat(pth); os.IsNotExist(err) {
+			err := updateServerInfo(filepath.Join(repoRoot, repo))
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
 		headerNoCache(w)
 		sendFile(w, r, "text/plain", pth)
 	}
 }
 
-// packetLine adds 4 digit hex length string to given string.
-func packetLine(l string) (string, error) {
-	h := strconv.FormatInt(int64(len(l)+4), 16)
-	if len(h) > 4 {
-		return "", errors.New("packet too long")
+// dumbHTTP wraps a service of dumb http protocol,
+// to refuse it when the protocol is disabled in the repo.
+func dumbHTTP(serv func(w http.ResponseWriter, r *http.Request, repo, pth string)) func(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	return func(w http.ResponseWriter, r *http.Request, repo, pth string) {
+		if !repoDumbHTTP(repo) {
+			http.Error(w, "dumb http protocol is disabled", http.StatusForbidden)
+			return
+		}
+		serv(w, r, repo, pth)
 	}
-	return strings.Repeat("0", 4-len(h)) + h + l, nil
+}
+
+// gitProtocol returns Git-Protocol header of the request,
+// which is passed to git as GIT_PROTOCOL environment variable.
+// It returns empty string if the header has unexpected characters.
+func gitProtocol(r *http.Request) string {
+	return validGitProtocol(r.Header.Get("Git-Protocol"))
+}
+
+// validGitProtocol returns the GIT_PROTOCOL value if it is safe to pass to git,
+// or empty string.
+func validGitProtocol(p string) string {
+	for _, c := range p {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("=:._-", c)) {
+			return ""
+		}
+	}
+	return p
+}
+
+// protocolV2 checks the client requested git protocol version 2.
+func protocolV2(r *http.Request) bool {
+	for _, kv := range strings.Split(gitProtocol(r), ":") {
+		if kv == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// gitEnv returns environment variables for a git service command of the request.
+// The user, if not empty, is passed to git hooks.
+func gitEnv(r *http.Request, user string) []string {
+	env := os.Environ()
+	if user != "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		// hooks show urls of web pages with it.
+		env = append(hookEnv(user, remoteIP(r)), "COLDMINE_URL="+scheme+"://"+r.Host)
+	}
+	if p := gitProtocol(r); p != "" {
+		env = append(env, "GIT_PROTOCOL="+p)
+	}
+	return env
 }
 
 func getTextFile(w http.ResponseWriter, r *http.Request, repo, pth string) {
@@ -75,66 +132,203 @@ func getTextFile(w http.ResponseWriter, r *http.Request, repo, pth string) {
 }
 
 func getInfoPacks(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	// TODO: pack file validation.
+	// the file could be stale when packs are changed without a push, ex. by git gc.
+	if !validInfoPacks(filepath.Join(repoRoot, repo)) {
+		err := updateServerInfo(filepath.Join(repoRoot, repo))
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
 	headerNoCache(w)
 	sendFile(w, r, "text/plain; charset=utf-8", pth)
 }
 
+var packNamePattern = regexp.MustCompile(`^pack-[0-9a-f]{40}\.pack$`)
+
+// validInfoPacks checks objects/info/packs of the git directory lists
+// exactly the packs in objects/pack, each of them having its index.
+func validInfoPacks(d string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(d, "objects/info/packs"))
+	if err != nil {
+		return false
+	}
+	listed := make(map[string]bool)
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "" {
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) != 2 || f[0] != "P" || !packNamePattern.MatchString(f[1]) {
+			return false
+		}
+		listed[f[1]] = true
+	}
+	idxs, err := filepath.Glob(filepath.Join(d, "objects/pack/pack-*.idx"))
+	if err != nil {
+		return false
+	}
+	n := 0
+	for _, idx := range idxs {
+		pack := strings.TrimSuffix(filepath.Base(idx), ".idx") + ".pack"
+		if _, err := os.Stat(filepath.Join(d, "objects/pack", pack)); err != nil {
+			// the pack is being written.
+			continue
+		}
+		if !listed[pack] {
+			return false
+		}
+		n++
+	}
+	return n == len(listed)
+}
+
 func getLooseObject(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	headerCacheForever(w)
+	headerCacheObject(w, repo)
 	sendFile(w, r, "x-git-loose-object", pth)
 }
 
 func getPackFile(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	headerCacheForever(w)
+	headerCacheObject(w, repo)
 	sendFile(w, r, "x-git-packed-objects", pth)
 }
 
 func getIdxFile(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	headerCacheForever(w)
+	headerCacheObject(w, repo)
 	sendFile(w, r, "x-git-packed-objects-toc", pth)
 }
 
 func serviceUpload(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	service(w, r, "upload-pack", repo, pth)
+	body, err := requestBody(r)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	service(w, r, "upload-pack", repo, "", body, nil)
 }
 
 func serviceReceive(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	if !checkAuth(r) {
-		w.Header().Set("WWW-Authenticate", `Basic realm="COLDMINE"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401 Unathorized\n"))
+	user, _ := requestAuth(r)
+	if user == "" {
+		requireAuth(w)
+		return
+	}
+	defer beginPush(repo)()
+	body, err := requestBody(r)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// read the commands before the pack, then give them to git again.
+	read := &bytes.Buffer{}
+	req, err := readReceiveRequest(io.TeeReader(body, read))
+	if err != nil {
+		log.Printf("invalid push to %v by %v: %v", repo, user, err)
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		newPktWriter(w).writeErr(fmt.Sprintf("invalid request: %v", err))
 		return
 	}
-	service(w, r, "receive-pack", repo, pth)
+	refs := make([]string, 0, len(req.Updates))
+	for _, u := range req.Updates {
+		refs = append(refs, u.Ref)
+	}
+	log.Printf("push to %v by %v: %v", repo, user, strings.Join(refs, " "))
+
+	// check names of the refs by the push policy, before git receives the pack.
+	policy, err := readPushPolicy(filepath.Join(repoRoot, repo))
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rejects, accepted := policy.checkNames(req)
+	for _, rj := range rejects {
+		log.Printf("reject %v of %v: %v", rj.Ref, repo, rj.Reason)
+	}
+	if len(rejects) == 0 {
+		service(w, r, "receive-pack", repo, user, io.MultiReader(read, body), nil)
+		return
+	}
+	if len(accepted) == 0 {
+		// git has nothing to do. read the rest before responding,
+		// the client may be still sending the pack.
+		io.Copy(ioutil.Discard, body)
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		err := writeReceiveStatus(w, req, rejects)
+		if err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	req.Updates = accepted
+	cmds := &bytes.Buffer{}
+	req.encode(cmds)
+	service(w, r, "receive-pack", repo, user, io.MultiReader(cmds, body), func(w io.Writer, out io.Reader) error {
+		return injectReceiveStatus(w, out, req, rejects)
+	})
+}
+
+// requestBody returns body of the request, which is uncompressed if needed.
+func requestBody(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return r.Body, nil
+	}
+	// git clients compress big requests of upload-pack.
+	return gzip.NewReader(r.Body)
 }
 
-func checkAuth(r *http.Request) bool {
+// checkAuth checks basic auth header of the request.
+// The password could be an access token of the user.
+// It returns the user name, and the token if it is used.
+func checkAuth(r *http.Request) (string, *accessToken, bool) {
 	r.ParseForm()
 	authHeader := r.Header.Get("Authorization")
 	auths := strings.Split(authHeader, " ")
 	if len(auths) != 2 || auths[0] != "Basic" {
-		return false
+		return "", nil, false
 	}
 	b, err := base64.StdEncoding.DecodeString(auths[1])
 	if err != nil {
-		return false
+		return "", nil, false
 	}
-	pair := strings.Split(string(b), ":")
+	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return false
+		return "", nil, false
 	}
 	user, passwd := pair[0], pair[1]
-	if user != "coldmine" || passwd != password {
-		return false
+	if !authAllowed(r, user) {
+		return "", nil, false
+	}
+	if strings.HasPrefix(passwd, tokenPrefix) {
+		// a password could start with the prefix too.
+		if tok := checkToken(user, passwd); tok != nil {
+			authResult(r, user, true)
+			return user, tok, true
+		}
+	}
+	ok := authenticate(user, passwd)
+	authResult(r, user, ok)
+	if !ok {
+		return "", nil, false
 	}
-	return true
+	return user, nil, true
 }
 
-func service(w http.ResponseWriter, r *http.Request, s, repo, pth string) {
+// service runs git service command for the repo.
+// The user, if not empty, is passed to git hooks as COLDMINE_USER.
+// The body is streamed to git, and its output to the client at the same time,
+// so a big push or fetch is not held in memory.
+// copyOut copies the output of git to the client, io.Copy is used if it is nil.
+func service(w http.ResponseWriter, r *http.Request, s, repo, user string, body io.Reader, copyOut func(io.Writer, io.Reader) error) {
 	w.Header().Set("Content-Type", "application/x-git-"+s+"-result")
 
 	cmd := exec.Command("git", s, "--stateless-rpc", filepath.Join(repoRoot, repo))
+	cmd.Env = gitEnv(r, user)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 
 	in, err := cmd.StdinPipe()
 	if err != nil {
@@ -154,15 +348,44 @@ func service(w http.ResponseWriter, r *http.Request, s, repo, pth string) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	// http/1.1 server closes the request body after the response is written,
+	// unless full duplex is enabled.
+	http.NewResponseController(w).EnableFullDuplex()
+	go func() {
+		_, err := io.Copy(in, body)
+		if err != nil {
+			log.Printf("could not send request body to git %v: %v", s, err)
+		}
+		in.Close()
+	}()
+	if copyOut == nil {
+		copyOut = func(w io.Writer, out io.Reader) error {
+			_, err := io.Copy(w, out)
+			return err
+		}
+	}
+	err = copyOut(flushWriter{w}, out)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		log.Printf("could not send git %v output: %v", s, err)
+	}
+	err = cmd.Wait()
+	if err != nil {
+		log.Printf("git %v failed: %v: %s", s, err, stderr.Bytes())
 	}
-	in.Write(body)
-	io.Copy(w, out)
-	cmd.Wait()
+}
+
+// flushWriter flushes every write to the client,
+// so progress messages of git are shown as soon as possible.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
 }
 
 func headerNoCache(w http.ResponseWriter) {
@@ -171,6 +394,16 @@ func headerNoCache(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
 }
 
+// headerCacheObject sets cache headers of an object of the repo, which never changes.
+// Shared caches should not keep objects of private repositories.
+func headerCacheObject(w http.ResponseWriter, repo string) {
+	if repoPrivate(repo) {
+		w.Header().Set("Cache-Control", "private, no-store")
+		return
+	}
+	headerCacheForever(w)
+}
+
 func headerCacheForever(w http.ResponseWriter) {
 	now := time.Now().Unix()
 	w.Header().Set("Date", fmt.Sprintf("%v", now))
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/skip2/go-qrcode"
 )
 
 func serveRoot(w http.ResponseWriter, r *http.Request) {
@@ -20,12 +29,27 @@ func serveRoot(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Fatalf("scan failed: %v", err)
 	}
+	// show only repositories the user could read.
+	u, csrf := sessionInfo(r)
+	for _, g := range grps {
+		repos := make([]repoInfo, 0, len(g.Repos))
+		for _, ri := range g.Repos {
+			if repoPerm(u, path.Join(g.Name, ri.Name)) >= permRead {
+				repos = append(repos, ri)
+			}
+		}
+		g.Repos = repos
+	}
 	info := struct {
 		Repo       string
 		RepoGroups []*repoGroup
+		Admin      bool
+		pageSession
 	}{
-		Repo:       "",
-		RepoGroups: grps,
+		Repo:        "",
+		RepoGroups:  grps,
+		Admin:       userAdmin(u),
+		pageSession: pageSession{u, csrf},
 	}
 	err = t.Execute(w, info)
 	if err != nil {
@@ -34,27 +58,66 @@ func serveRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func serveRootAction(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-
-	if r.Form.Get("password") != password {
-		http.Error(w, "password not matched", http.StatusForbidden)
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
 		return
 	}
 
 	add := r.Form.Get("addRepo")
 	if add != "" {
-		log.Printf("add repo: %v", add)
+		if !userAdmin(user) {
+			http.Error(w, "only admins could add a repository", http.StatusForbidden)
+			return
+		}
+		mirror := r.Form.Get("mirror")
+		if mirror != "" {
+			if err := validMirrorURL(mirror); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("%v", err)))
+				return
+			}
+		}
+		log.Printf("add repo: %v (by %v)", add, user)
 		err := addRepo(add)
+		if err == nil {
+			if r.Form.Get("private") != "" {
+				err = setRepoPrivate(add, true)
+			}
+			if err == nil && mirror != "" {
+				err = setupMirror(add, mirror)
+			}
+			if err != nil {
+				// do not leave a public repo, or a repo could be pushed instead of a mirror.
+				if e := removeRepo(add); e != nil {
+					log.Printf("could not remove half made repo %v: %v", add, e)
+				}
+			}
+		}
 		if err != nil {
 			log.Print(err)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(fmt.Sprintf("%v", err)))
 			return
 		}
+		audit(r, user, "add repo", add, "")
+		if mirror != "" {
+			// fetching could take long.
+			go func() {
+				err := syncMirror(add)
+				if err != nil {
+					log.Printf("could not sync mirror %v: %v", add, err)
+				}
+			}()
+		}
 	}
 	rm := r.Form.Get("removeRepo")
 	if rm != "" {
-		log.Printf("remove repo: %v", rm)
+		if !userAdmin(user) {
+			http.Error(w, "only admins could remove a repository", http.StatusForbidden)
+			return
+		}
+		log.Printf("remove repo: %v (by %v)", rm, user)
 		err := removeRepo(rm)
 		if err != nil {
 			log.Print(err)
@@ -62,10 +125,540 @@ func serveRootAction(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(fmt.Sprintf("%v", err)))
 			return
 		}
+		audit(r, user, "remove repo", rm, "")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	next := r.Form.Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	failed := ""
+	// pending is set when the user passed the password,
+	// and the second factor is needed.
+	pending := ""
+	login := func(user string) {
+		authResult(r, user, true)
+		err := setSession(w, r, user)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("login: %v", user)
+		if userAdmin(user) && !totpEnabled(user) {
+			next = "/2fa/"
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+	if r.Method == "POST" && r.Form.Get("pending") != "" {
+		user := pendingUser(r.Form.Get("pending"))
+		if user == "" {
+			failed = "login expired, please try again"
+		} else if !authAllowed(r, user) {
+			failed = "too many failures, please try later"
+		} else if !checkSecondFactor(user, r.Form.Get("code")) {
+			authResult(r, user, false)
+			failed = "code not matched"
+			pending = r.Form.Get("pending")
+		} else {
+			login(user)
+			return
+		}
+	} else if r.Method == "POST" {
+		user := r.Form.Get("user")
+		if !authAllowed(r, user) {
+			failed = "too many failures, please try later"
+		} else if !authenticate(user, r.Form.Get("password")) {
+			authResult(r, user, false)
+			failed = "user or password not matched"
+		} else if totpEnabled(user) {
+			pending = pendingLogin(user)
+		} else {
+			login(user)
+			return
+		}
+	}
+	u, csrf := sessionInfo(r)
+	info := struct {
+		Repo    string
+		Next    string
+		Pending string
+		Failed  string
+		pageSession
+	}{
+		Repo:        "",
+		Next:        next,
+		Pending:     pending,
+		Failed:      failed,
+		pageSession: pageSession{u, csrf},
+	}
+	err := loginTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
 	}
+	log.Printf("logout: %v", user)
+	// the cookie could be kept by someone, make it invalid in the server too.
+	err := endSessions(user)
+	if err != nil {
+		log.Print(err)
+	}
+	clearSession(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+func serveUsers(w http.ResponseWriter, r *http.Request) {
+	// users are not shown to anonymous visitors.
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/users/", http.StatusSeeOther)
+		return
+	}
+	users, err := listUsers()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	info := struct {
+		Repo  string
+		Users []user
+		Admin bool
+		pageSession
+	}{
+		Repo:        "",
+		Users:       users,
+		Admin:       userAdmin(u),
+		pageSession: pageSession{u, csrf},
+	}
+	err = usersTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveUsersAction(w http.ResponseWriter, r *http.Request) {
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+
+	if !userAdmin(user) {
+		http.Error(w, "only admins could manage users", http.StatusForbidden)
+		return
+	}
+
+	target := r.Form.Get("target")
+	act := r.Form.Get("action")
+	log.Printf("%v user: %v (by %v)", act, target, user)
+	audit(r, user, act+" user", "", target)
+	var err error
+	switch act {
+	case "add":
+		err = addUser(target, r.Form.Get("newPassword"))
+	case "remove":
+		if target == user {
+			err = errors.New("could not remove yourself.")
+			break
+		}
+		err = removeUser(target)
+	case "disable":
+		if target == user {
+			err = errors.New("could not disable yourself.")
+			break
+		}
+		err = setUserDisabled(target, true)
+	case "enable":
+		err = setUserDisabled(target, false)
+	case "admin":
+		err = setUserAdmin(target, true)
+	case "reset2fa":
+		// for users who lost both of their device and recovery codes.
+		if target == user {
+			err = errors.New("could not reset two-factor authentication of yourself.")
+			break
+		}
+		if !userExist(target) {
+			err = fmt.Errorf("user not exist: %v", target)
+			break
+		}
+		err = disableTOTP(target)
+	case "member":
+		if target == user {
+			err = errors.New("could not drop admin role of yourself.")
+			break
+		}
+		err = setUserAdmin(target, false)
+	case "password":
+		if _, local := authenticator.(localAuth); !local {
+			err = fmt.Errorf("password is managed by %v authentication", authBackend)
+			break
+		}
+		if !userExist(target) {
+			err = fmt.Errorf("user not exist: %v", target)
+			break
+		}
+		err = setPassword(target, r.Form.Get("newPassword"))
+		if err == nil {
+			err = endSessions(target)
+		}
+	default:
+		err = fmt.Errorf("unknown action: %v", act)
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+	http.Redirect(w, r, "/users/", http.StatusSeeOther)
+}
+
+// serveTwoFactor shows two-factor authentication status of the logged in user,
+// or a QR code to enroll.
+func serveTwoFactor(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactor(w, r, nil)
+}
+
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, codes []string) {
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/2fa/", http.StatusSeeOther)
+		return
+	}
+	enabled := totpEnabled(u)
+	secret := ""
+	var qr template.URL
+	if !enabled {
+		var err error
+		secret, err = newTOTPSecret()
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		png, err := qrcode.Encode(totpURL(u, secret), qrcode.Medium, 256)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		qr = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	info := struct {
+		Repo          string
+		Enabled       bool
+		Required      bool
+		Secret        string
+		SecretSig     string
+		QRCode        template.URL
+		RecoveryCodes []string
+		RecoveryLeft  int
+		pageSession
+	}{
+		Repo:          "",
+		Enabled:       enabled,
+		Required:      userAdmin(u),
+		Secret:        secret,
+		SecretSig:     signTOTPSecret(u, secret),
+		QRCode:        qr,
+		RecoveryCodes: codes,
+		RecoveryLeft:  recoveryLeft(u),
+		pageSession:   pageSession{u, csrf},
+	}
+	err := twoFactorTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveTwoFactorAction(w http.ResponseWriter, r *http.Request) {
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+	if !authAllowed(r, user) {
+		http.Error(w, "too many failures, please try later", http.StatusForbidden)
+		return
+	}
+
+	code := r.Form.Get("code")
+	var codes []string
+	var err error
+	switch act := r.Form.Get("action"); act {
+	case "enable":
+		secret := r.Form.Get("secret")
+		if !validTOTPSecretSig(user, secret, r.Form.Get("secretSig")) {
+			err = errors.New("invalid or expired secret, please reload the page")
+			break
+		}
+		codes, err = enableTOTP(user, secret, code)
+	case "recovery":
+		if !checkSecondFactor(user, code) {
+			authResult(r, user, false)
+			err = errors.New("code not matched")
+			break
+		}
+		codes, err = newRecoveryCodes(user)
+	case "disable":
+		if userAdmin(user) {
+			err = errors.New("admins could not disable two-factor authentication")
+			break
+		}
+		if !checkSecondFactor(user, code) {
+			authResult(r, user, false)
+			err = errors.New("code not matched")
+			break
+		}
+		err = disableTOTP(user)
+	default:
+		err = fmt.Errorf("unknown action: %v", act)
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+	log.Printf("%v 2fa (by %v)", r.Form.Get("action"), user)
+	audit(r, user, r.Form.Get("action")+" 2fa", "", "")
+	if codes != nil {
+		renderTwoFactor(w, r, codes)
+		return
+	}
+	http.Redirect(w, r, "/2fa/", http.StatusSeeOther)
+}
+
+// serveTokens shows access tokens of the logged in user.
+func serveTokens(w http.ResponseWriter, r *http.Request) {
+	renderTokens(w, r, "")
+}
+
+// renderTokens renders tokens page. newTok is shown only once after it is created.
+func renderTokens(w http.ResponseWriter, r *http.Request, newTok string) {
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/tokens/", http.StatusSeeOther)
+		return
+	}
+	toks, err := listTokens(u)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	info := struct {
+		Repo     string
+		Tokens   []*accessToken
+		NewToken string
+		pageSession
+	}{
+		Repo:        "",
+		Tokens:      toks,
+		NewToken:    newTok,
+		pageSession: pageSession{u, csrf},
+	}
+	err = tokensTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveTokensAction(w http.ResponseWriter, r *http.Request) {
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+
+	switch act := r.Form.Get("action"); act {
+	case "create":
+		days, err := strconv.Atoi(r.Form.Get("days"))
+		if err != nil {
+			days = 0
+		}
+		name := r.Form.Get("name")
+		tok, err := createToken(user, name, permNames[r.Form.Get("scope")], r.Form.Get("repo"), days)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("%v", err)))
+			return
+		}
+		log.Printf("create token: %v (by %v)", name, user)
+		audit(r, user, "create token", "", name)
+		renderTokens(w, r, tok)
+	case "revoke":
+		id := r.Form.Get("id")
+		err := revokeToken(user, id)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("%v", err)))
+			return
+		}
+		log.Printf("revoke token: %v (by %v)", id, user)
+		audit(r, user, "revoke token", "", id)
+		http.Redirect(w, r, "/tokens/", http.StatusSeeOther)
+	default:
+		http.Error(w, fmt.Sprintf("unknown action: %v", act), http.StatusBadRequest)
+	}
+}
+
+// serveKeys shows ssh public keys of the logged in user.
+func serveKeys(w http.ResponseWriter, r *http.Request) {
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/keys/", http.StatusSeeOther)
+		return
+	}
+	keys, err := listSSHKeys(u)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	info := struct {
+		Repo string
+		Keys []*sshKey
+		pageSession
+	}{
+		Repo:        "",
+		Keys:        keys,
+		pageSession: pageSession{u, csrf},
+	}
+	err = keysTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveKeysAction(w http.ResponseWriter, r *http.Request) {
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch act := r.Form.Get("action"); act {
+	case "add":
+		log.Printf("add ssh key (by %v)", user)
+		audit(r, user, "add ssh key", "", "")
+		err = addSSHKey(user, r.Form.Get("key"))
+	case "remove":
+		log.Printf("remove ssh key: %v (by %v)", r.Form.Get("fingerprint"), user)
+		audit(r, user, "remove ssh key", "", r.Form.Get("fingerprint"))
+		err = removeSSHKey(user, r.Form.Get("fingerprint"))
+	default:
+		err = fmt.Errorf("unknown action: %v", act)
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+	http.Redirect(w, r, "/keys/", http.StatusSeeOther)
+}
+
+// serveMaintenance shows the last maintenance of each repository to admins.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/maintenance/", http.StatusSeeOther)
+		return
+	}
+	if !userAdmin(u) {
+		http.Error(w, "only admins could see maintenance status", http.StatusForbidden)
+		return
+	}
+	repos, err := allRepos()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	status := make([]maintenanceStatus, 0, len(repos))
+	for _, repo := range repos {
+		status = append(status, readMaintenanceStatus(repo))
+	}
+	info := struct {
+		Repo     string
+		Pushes   int
+		Interval time.Duration
+		Status   []maintenanceStatus
+		pageSession
+	}{
+		Repo:        "",
+		Pushes:      maintenancePushes,
+		Interval:    maintenanceInterval,
+		Status:      status,
+		pageSession: pageSession{u, csrf},
+	}
+	err = maintenanceTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// serveAudit shows the audit log, filtered by actor, action and repo.
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	u, csrf := sessionInfo(r)
+	if u == "" {
+		http.Redirect(w, r, "/login?next=/audit/", http.StatusSeeOther)
+		return
+	}
+	if !userAdmin(u) {
+		http.Error(w, "only admins could see the audit log", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	filter := auditEntry{
+		Actor:  r.Form.Get("actor"),
+		Action: r.Form.Get("action"),
+		Repo:   r.Form.Get("repo"),
+	}
+	entries, err := readAudit(filter, 500)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	info := struct {
+		Repo    string
+		Filter  auditEntry
+		Entries []auditEntry
+		pageSession
+	}{
+		Repo:        "",
+		Filter:      filter,
+		Entries:     entries,
+		pageSession: pageSession{u, csrf},
+	}
+	err = auditTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
 func serveInit(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	var newIPAddr string
 	ip := strings.Split(ipAddr, ":")
@@ -81,12 +674,23 @@ func serveInit(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		}
 		newIPAddr = strings.Join(ip, ":")
 	}
+	u, csrf := sessionInfo(r)
+	scheme := "http"
+	if tlsCert != "" {
+		scheme = "https"
+	}
 	info := struct {
-		Repo string
-		IP   string
+		Repo   string
+		Scheme string
+		IP     string
+		SSH    string
+		pageSession
 	}{
-		Repo: repo,
-		IP:   newIPAddr,
+		Repo:        repo,
+		Scheme:      scheme,
+		IP:          newIPAddr,
+		SSH:         sshRemote(newIPAddr, repo),
+		pageSession: pageSession{u, csrf},
 	}
 	t, err := template.ParseFiles("init.html", "head.html", "top.html")
 	if err != nil {
@@ -147,16 +751,19 @@ func serveOverview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		}
 	}
 
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo      string
 		Branches  []string
 		HasReadme bool
 		Readme    string
+		pageSession
 	}{
-		Repo:      repo,
-		Branches:  branches,
-		HasReadme: hasReadme,
-		Readme:    readme,
+		Repo:        repo,
+		Branches:    branches,
+		HasReadme:   hasReadme,
+		Readme:      readme,
+		pageSession: pageSession{u, csrf},
 	}
 	err = overviewTmpl.Execute(w, info)
 	if err != nil {
@@ -187,12 +794,15 @@ func serveCommit(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo     string
 		Contents []string
+		pageSession
 	}{
-		Repo:     repo,
-		Contents: strings.SplitAfter(string(out), "\n"),
+		Repo:        repo,
+		Contents:    strings.SplitAfter(string(out), "\n"),
+		pageSession: pageSession{u, csrf},
 	}
 	err = commitTmpl.Execute(w, info)
 	if err != nil {
@@ -217,16 +827,65 @@ func serveTree(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo    string
 		TopTree *Tree
+		pageSession
 	}{
-		Repo:    repo,
-		TopTree: top,
+		Repo:        repo,
+		TopTree:     top,
+		pageSession: pageSession{u, csrf},
 	}
 	treeTmpl.Execute(w, info)
 }
 
+// archiveFormats are formats of git archive, by the suffix of the url.
+var archiveFormats = map[string]string{
+	".tar.gz": "tar.gz",
+	".zip":    "zip",
+}
+
+// serveArchive streams an archive of a ref, a commit or a tree,
+// like /<repo>/archive/master.tar.gz.
+func serveArchive(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	// the url could have .git suffix on the repo.
+	_, subpath := splitURLPath(r.URL.Path)
+	name := strings.TrimPrefix(subpath, "/archive/")
+	format, ref := "", ""
+	for suffix, f := range archiveFormats {
+		if strings.HasSuffix(name, suffix) {
+			format, ref = f, strings.TrimSuffix(name, suffix)
+		}
+	}
+	// refs starting with "-" would be options of git.
+	if format == "" || ref == "" || strings.HasPrefix(ref, "-") {
+		http.NotFound(w, r)
+		return
+	}
+	d := filepath.Join(repoRoot, repo)
+	cmd := exec.Command("git", "cat-file", "-e", ref+"^{tree}")
+	cmd.Dir = d
+	err := cmd.Run()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	base := path.Base(repo) + "-" + strings.Replace(ref, "/", "-", -1)
+	cmd = exec.Command("git", "archive", "--format="+format, "--prefix="+base+"/", ref)
+	cmd.Dir = d
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+"."+format))
+	cmd.Stdout = w
+	err = cmd.Run()
+	if err != nil {
+		// the header is already sent.
+		log.Printf("%v: (%v) %s", cmd.Args, err, stderr)
+	}
+}
+
 func serveBlob(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	pp := strings.Split(pth, "/")
 	if pp[len(pp)-2] != "blob" {
@@ -241,12 +900,36 @@ func serveBlob(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// show the real file instead of a git lfs pointer.
+	lfsOid, lfsSize := "", int64(0)
+	if oid, size, ok := lfsPointer(c); ok && lfsObjectSize(repo, oid) == size {
+		lfsOid, lfsSize = oid, size
+		c = nil
+		if size <= maxLFSPreview {
+			o, err := ioutil.ReadFile(lfsObjectPath(repo, oid))
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if utf8.Valid(o) && bytes.IndexByte(o, 0) < 0 {
+				c = o
+			}
+		}
+	}
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo    string
 		Content string
+		LFSOid  string
+		LFSSize int64
+		pageSession
 	}{
-		Repo:    repo,
-		Content: string(c),
+		Repo:        repo,
+		Content:     string(c),
+		LFSOid:      lfsOid,
+		LFSSize:     lfsSize,
+		pageSession: pageSession{u, csrf},
 	}
 	blobTmpl.Execute(w, info)
 }
@@ -268,7 +951,7 @@ func serveLog(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	cmd.Dir = filepath.Join(repoRoot, repo)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Print("%v: (%v) %s", cmd, err, out)
+		log.Printf("%v: (%v) %s", cmd, err, out)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -310,7 +993,7 @@ func serveLog(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	cmd.Dir = filepath.Join(repoRoot, repo)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
-		log.Print("%v: (%v) %s", cmd, err, out)
+		log.Printf("%v: (%v) %s", cmd, err, out)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -321,16 +1004,19 @@ func serveLog(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		logs = append(logs, logEl{ID: cc[0], Date: simpleDate, Subject: cc[2]})
 	}
 
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo string
 		Logs []logEl
 		Prev int
 		Next int
+		pageSession
 	}{
-		Repo: repo,
-		Logs: logs,
-		Prev: prevPage,
-		Next: nextPage,
+		Repo:        repo,
+		Logs:        logs,
+		Prev:        prevPage,
+		Next:        nextPage,
+		pageSession: pageSession{u, csrf},
 	}
 	err = logTmpl.Execute(w, info)
 	if err != nil {
@@ -339,12 +1025,15 @@ func serveLog(w http.ResponseWriter, r *http.Request, repo, pth string) {
 }
 
 func serveReviews(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo    string
 		Reviews []review
+		pageSession
 	}{
-		Repo:    repo,
-		Reviews: listReviews(repo, 50),
+		Repo:        repo,
+		Reviews:     listReviews(repo, 50),
+		pageSession: pageSession{u, csrf},
 	}
 	err := reviewsTmpl.Execute(w, info)
 	if err != nil {
@@ -353,17 +1042,27 @@ func serveReviews(w http.ResponseWriter, r *http.Request, repo, pth string) {
 }
 
 func serveReviewsAction(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	r.ParseForm()
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
 
-	if r.Form.Get("password") != password {
-		http.Error(w, "password not matched", http.StatusForbidden)
+	if repoPerm(user, repo) < permWrite {
+		http.Error(w, "no permission to the repository", http.StatusForbidden)
 		return
 	}
 
 	title := r.Form.Get("title")
 	if title != "" {
-		log.Printf("create a new review: %v", title)
-		createReview(repo, title)
+		log.Printf("create a new review: %v (by %v)", title, user)
+		audit(r, user, "create review", repo, title)
+		_, err := createReview(repo, title)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	http.Redirect(w, r, "/"+repo+"/reviews/", http.StatusSeeOther)
@@ -372,7 +1071,7 @@ func serveReviewsAction(w http.ResponseWriter, r *http.Request, repo, pth string
 func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	pp := strings.Split(r.URL.Path, "/")
 	nstr := pp[len(pp)-1]
-	_, err := strconv.Atoi(nstr)
+	n, err := strconv.Atoi(nstr)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
@@ -398,14 +1097,15 @@ func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	reviewStatus := ss[len(ss)-1]
 
 	// check the review branch actually pushed.
-	b := "coldmine/review/" + nstr
+	b := reviewRef(repo, n)
 	cmd := exec.Command("git", "branch")
 	cmd.Dir = filepath.Join(repoRoot, repo)
 	out, err := cmd.Output()
 	if err != nil {
 		log.Fatalf("%v: (%v) %s", cmd, err, out)
 	}
-	find := false
+	// hidden review refs are not branches, reviewRef returns them only when they exist.
+	find := strings.HasPrefix(b, "refs/")
 	for _, l := range strings.Split(string(out), "\n") {
 		l = strings.TrimLeft(l, "* ")
 		if l == b {
@@ -413,12 +1113,15 @@ func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 		}
 	}
 	if !find {
+		u, csrf := sessionInfo(r)
 		info := struct {
 			Repo   string
 			Branch string
+			pageSession
 		}{
-			Repo:   repo,
-			Branch: b,
+			Repo:        repo,
+			Branch:      b,
+			pageSession: pageSession{u, csrf},
 		}
 		err = reviewInitTmpl.Execute(w, info)
 		if err != nil {
@@ -429,7 +1132,7 @@ func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 
 	// find merge-base commit between review branch and target branch.
 
-	baseB := "master"
+	baseB := reviewTarget(repo, n)
 	commits, err := reviewCommits(repo, b, baseB)
 	if err != nil {
 		log.Fatal(err)
@@ -459,18 +1162,21 @@ func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 	diffLines := strings.SplitAfter(diff, "\n")
 
 	// serve
+	u, csrf := sessionInfo(r)
 	info := struct {
 		Repo         string
 		ReviewNum    string
 		ReviewStatus string
 		Commits      []string
 		DiffLines    []string
+		pageSession
 	}{
 		Repo:         repo,
 		ReviewNum:    nstr,
 		ReviewStatus: reviewStatus,
 		Commits:      commits,
 		DiffLines:    diffLines,
+		pageSession:  pageSession{u, csrf},
 	}
 	err = reviewTmpl.Execute(w, info)
 	if err != nil {
@@ -479,9 +1185,13 @@ func serveReview(w http.ResponseWriter, r *http.Request, repo, pth string) {
 }
 
 func serveReviewAction(w http.ResponseWriter, r *http.Request, repo, pth string) {
-	r.ParseForm()
-	if r.Form.Get("password") != password {
-		http.Error(w, "password not matched", http.StatusForbidden)
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+	if repoPerm(user, repo) < permWrite {
+		http.Error(w, "no permission to the repository", http.StatusForbidden)
 		return
 	}
 	nstr := r.Form.Get("n")
@@ -492,11 +1202,146 @@ func serveReviewAction(w http.ResponseWriter, r *http.Request, repo, pth string)
 		return
 	}
 	act := r.Form.Get("action")
+	if act == "merge" && repoMirror(repo) != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("could not merge a review of a mirror"))
+		return
+	}
+	log.Printf("%v review %v of %v (by %v)", act, n, repo, user)
+	audit(r, user, act+" review", repo, nstr)
 	if act == "merge" {
-		mergeReview(repo, n, "coldmine/review/"+nstr, "master")
+		mergeReview(repo, n, reviewRef(repo, n), reviewTarget(repo, n), user)
 	} else if act == "close" {
 		closeReview(repo, n)
 	}
 	redirectPath := strings.TrimSuffix(r.URL.Path, "action") + nstr
 	http.Redirect(w, r, redirectPath, http.StatusSeeOther)
 }
+
+func serveSettings(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	rules, err := protectRules(filepath.Join(repoRoot, repo))
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	policy, err := readPushPolicy(filepath.Join(repoRoot, repo))
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	u, csrf := sessionInfo(r)
+	info := struct {
+		Repo         string
+		Private      bool
+		Mirror       string
+		MirrorSynced string
+		MirrorError  string
+		DumbHTTP     bool
+		GitSettings  []repoGitSetting
+		ProtectRules []*protectRule
+		Policy       *pushPolicy
+		pageSession
+	}{
+		Repo:         repo,
+		Private:      repoPrivate(repo),
+		Mirror:       repoMirror(repo),
+		MirrorSynced: mirrorSynced(filepath.Join(repoRoot, repo)),
+		MirrorError:  gitConfig(filepath.Join(repoRoot, repo), "coldmine.mirrorError"),
+		DumbHTTP:     repoDumbHTTP(repo),
+		GitSettings:  repoGitSettings(repo),
+		ProtectRules: rules,
+		Policy:       policy,
+		pageSession:  pageSession{u, csrf},
+	}
+	err = settingsTmpl.Execute(w, info)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func serveSettingsAction(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	user, ok := actionUser(r)
+	if !ok {
+		http.Error(w, "login required or invalid form", http.StatusForbidden)
+		return
+	}
+	if repoPerm(user, repo) < permAdmin {
+		http.Error(w, "no permission to the repository", http.StatusForbidden)
+		return
+	}
+
+	act := r.Form.Get("action")
+	branch := r.Form.Get("branch")
+	var err error
+	switch act {
+	case "visibility":
+		private := r.Form.Get("visibility") == "private"
+		log.Printf("set %v private: %v (by %v)", repo, private, user)
+		audit(r, user, "set visibility", repo, r.Form.Get("visibility"))
+		err = setRepoPrivate(repo, private)
+	case "sync":
+		log.Printf("sync mirror %v (by %v)", repo, user)
+		audit(r, user, "sync mirror", repo, "")
+		err = syncMirror(repo)
+	case "dumbhttp":
+		enable := r.Form.Get("dumbhttp") == "enable"
+		log.Printf("set %v dumb http: %v (by %v)", repo, enable, user)
+		audit(r, user, "set dumb http", repo, r.Form.Get("dumbhttp"))
+		err = setRepoDumbHTTP(repo, enable)
+		if err == nil && enable {
+			// server info is not updated while it is disabled.
+			err = updateServerInfo(filepath.Join(repoRoot, repo))
+		}
+	case "gitsettings":
+		values := make(map[string]bool)
+		for _, s := range gitSettings {
+			values[s.Key] = r.Form.Get(s.Key) != ""
+		}
+		log.Printf("set git settings of %v (by %v)", repo, user)
+		audit(r, user, "set git settings", repo, "")
+		err = setRepoGitSettings(repo, values)
+	case "protect":
+		log.Printf("protect %v of %v (by %v)", branch, repo, user)
+		audit(r, user, "protect branch", repo, branch)
+		err = addProtectRule(repo, &protectRule{
+			Branch:   branch,
+			NoPush:   r.Form.Get("nopush") != "",
+			NoForce:  r.Form.Get("noforce") != "",
+			NoDelete: r.Form.Get("nodelete") != "",
+			Pushers:  strings.Fields(r.Form.Get("pushers")),
+		})
+	case "unprotect":
+		log.Printf("unprotect %v of %v (by %v)", branch, repo, user)
+		audit(r, user, "unprotect branch", repo, branch)
+		err = removeProtectRule(repo, branch)
+	case "policy":
+		var size int64
+		if s := r.Form.Get("maxBlobSize"); s != "" {
+			size, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("invalid max blob size: %v", s)
+				break
+			}
+		}
+		log.Printf("set push policy of %v (by %v)", repo, user)
+		audit(r, user, "set push policy", repo, "")
+		err = setPushPolicy(repo, &pushPolicy{
+			MaxBlobSize:    size,
+			ForbiddenPaths: strings.Fields(r.Form.Get("forbiddenPaths")),
+			BranchPattern:  r.Form.Get("branchPattern"),
+			TagPattern:     r.Form.Get("tagPattern"),
+			MessagePattern: r.Form.Get("messagePattern"),
+		})
+	default:
+		err = fmt.Errorf("unknown action: %v", act)
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+	http.Redirect(w, r, "/"+repo+"/settings/", http.StatusSeeOther)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Git LFS objects of a repository are saved in lfs/objects directory
+// of the bare repository, like lfs/objects/ab/cd/abcd...
+// They are served with the batch API and the basic transfer adapter.
+// See https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// maxLFSPreview is the max size of an object shown in the blob page.
+const maxLFSPreview = 1 << 20
+
+var lfsOidPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type lfsObject struct {
+	Oid     string                `json:"oid"`
+	Size    int64                 `json:"size"`
+	Actions map[string]*lfsAction `json:"actions,omitempty"`
+	Error   *lfsError             `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+}
+
+func lfsObjectPath(repo, oid string) string {
+	return filepath.Join(repoRoot, repo, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// lfsObjectSize returns size of the object, or -1 if the object does not exist.
+func lfsObjectSize(repo, oid string) int64 {
+	fi, err := os.Stat(lfsObjectPath(repo, oid))
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// lfsPointer parses a pointer file, which is saved in git instead of the real file.
+func lfsPointer(b []byte) (string, int64, bool) {
+	if len(b) > 1024 || !bytes.HasPrefix(b, []byte("version https://git-lfs.github.com/spec/v1\n")) {
+		return "", 0, false
+	}
+	oid, size := "", int64(-1)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), " ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "oid":
+			oid = strings.TrimPrefix(kv[1], "sha256:")
+		case "size":
+			size, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+	if !lfsOidPattern.MatchString(oid) || size < 0 {
+		return "", 0, false
+	}
+	return oid, size, true
+}
+
+func lfsWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func lfsWriteError(w http.ResponseWriter, status int, msg string) {
+	lfsWriteJSON(w, status, struct {
+		Message string `json:"message"`
+	}{msg})
+}
+
+// serveLFSBatch tells the client where to download or upload the objects.
+// Upload needs the permission to push, like serviceReceive,
+// and is rejected for mirrors as they could not be pushed.
+func serveLFSBatch(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	var req lfsBatchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		lfsWriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		lfsWriteError(w, http.StatusBadRequest, fmt.Sprintf("unknown operation: %v", req.Operation))
+		return
+	}
+	if req.Operation == "upload" {
+		user, tok := requestAuth(r)
+		p := repoPerm(user, repo)
+		if tok != nil {
+			p = tok.limit(repo, p)
+		}
+		if p < permWrite {
+			if user == "" {
+				w.Header().Set("LFS-Authenticate", `Basic realm="COLDMINE"`)
+				requireAuth(w)
+				return
+			}
+			lfsWriteError(w, http.StatusForbidden, "no permission to push")
+			return
+		}
+		if repoMirror(repo) != "" {
+			lfsWriteError(w, http.StatusForbidden, "could not upload to a mirror")
+			return
+		}
+	}
+	if len(req.Transfers) != 0 {
+		basic := false
+		for _, t := range req.Transfers {
+			if t == "basic" {
+				basic = true
+			}
+		}
+		if !basic {
+			lfsWriteError(w, http.StatusUnprocessableEntity, "only basic transfer is supported")
+			return
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// the client uses same credentials for the objects.
+	var header map[string]string
+	if a := r.Header.Get("Authorization"); a != "" {
+		header = map[string]string{"Authorization": a}
+	}
+	objs := make([]lfsObject, 0, len(req.Objects))
+	for _, o := range req.Objects {
+		obj := lfsObject{Oid: o.Oid, Size: o.Size}
+		if !lfsOidPattern.MatchString(o.Oid) || o.Size < 0 {
+			obj.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+			objs = append(objs, obj)
+			continue
+		}
+		act := &lfsAction{Href: scheme + "://" + r.Host + "/" + repo + "/info/lfs/objects/" + o.Oid, Header: header}
+		size := lfsObjectSize(repo, o.Oid)
+		if req.Operation == "download" {
+			if size < 0 {
+				obj.Error = &lfsError{Code: http.StatusNotFound, Message: "object not exist"}
+			} else {
+				obj.Size = size
+				obj.Actions = map[string]*lfsAction{"download": act}
+			}
+		} else if size != o.Size {
+			// no action is needed for objects already uploaded.
+			obj.Actions = map[string]*lfsAction{"upload": act}
+		}
+		objs = append(objs, obj)
+	}
+	lfsWriteJSON(w, http.StatusOK, lfsBatchResponse{Transfer: "basic", Objects: objs})
+}
+
+func getLFSObject(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	oid := path.Base(r.URL.Path)
+	headerCacheObject(w, repo)
+	sendFile(w, r, "application/octet-stream", lfsObjectPath(repo, oid))
+}
+
+// putLFSObject saves an uploaded object, after checking its hash.
+func putLFSObject(w http.ResponseWriter, r *http.Request, repo, pth string) {
+	if repoMirror(repo) != "" {
+		lfsWriteError(w, http.StatusForbidden, "could not upload to a mirror")
+		return
+	}
+	oid := path.Base(r.URL.Path)
+	dst := lfsObjectPath(repo, oid)
+	tmpDir := filepath.Join(repoRoot, repo, "lfs", "tmp")
+	err := os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		log.Print(err)
+		lfsWriteError(w, http.StatusInternalServerError, "could not save the object")
+		return
+	}
+	f, err := ioutil.TempFile(tmpDir, oid)
+	if err != nil {
+		log.Print(err)
+		lfsWriteError(w, http.StatusInternalServerError, "could not save the object")
+		return
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r.Body)
+	f.Close()
+	if err != nil {
+		log.Print(err)
+		lfsWriteError(w, http.StatusBadRequest, "could not read the object")
+		return
+	}
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		lfsWriteError(w, http.StatusUnprocessableEntity, "object hash not matched")
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		log.Print(err)
+		lfsWriteError(w, http.StatusInternalServerError, "could not save the object")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repositories are maintained in background, after -maintenance-pushes pushes
+// or -maintenance-interval since the last maintenance, so packs do not pile up.
+// The result is saved in git config of the bare repository.
+// A repository never maintained gets the time of its first maintenance,
+// at random in the interval, so repositories are not maintained all at once
+// after coldmine is upgraded.
+//
+//	[coldmine]
+//		maintenanceFirst = 2020-01-01T18:30:00Z
+//		maintenanceTime = 2020-01-02T15:04:05Z
+//		maintenanceDuration = 1.2s
+//		maintenanceError = git gc: exit status 128
+var (
+	maintenancePushes   int
+	maintenanceInterval time.Duration
+)
+
+// maintenanceTasks are git commands run for maintenance in order.
+var maintenanceTasks = [][]string{
+	// gc repacks objects into a pack with bitmaps, packs refs and prunes old unreachable objects.
+	{"-c", "repack.writeBitmaps=true", "gc", "--quiet"},
+	// commit-graph with changed paths makes log and merge-base faster.
+	{"commit-graph", "write", "--reachable", "--changed-paths"},
+}
+
+// repoLock prevents maintenance of a repo while it is being pushed,
+// as gc could remove objects the push is writing.
+// Pushes could run together.
+type repoLock struct {
+	sync.RWMutex
+	// pushes is the number of pushes since the last maintenance.
+	pushes  int
+	running bool
+	// syncing is true while a mirror is fetched, and syncTried is when it is started.
+	syncing   bool
+	syncTried time.Time
+}
+
+var repoLocks = struct {
+	sync.Mutex
+	m map[string]*repoLock
+}{m: make(map[string]*repoLock)}
+
+func lockOf(repo string) *repoLock {
+	repoLocks.Lock()
+	defer repoLocks.Unlock()
+	l, ok := repoLocks.m[repo]
+	if !ok {
+		l = &repoLock{}
+		repoLocks.m[repo] = l
+	}
+	return l
+}
+
+// beginPush waits maintenance of the repo if it is running,
+// then returns a function which should be called after the push.
+func beginPush(repo string) func() {
+	l := lockOf(repo)
+	l.RLock()
+	return func() {
+		repoLocks.Lock()
+		l.pushes++
+		repoLocks.Unlock()
+		l.RUnlock()
+	}
+}
+
+// maintenanceStatus is the status of maintenance of a repo.
+type maintenanceStatus struct {
+	Repo string
+	// First is when the first maintenance is due, if it was never maintained.
+	First    time.Time
+	Time     time.Time
+	Duration string
+	Error    string
+	Pushes   int
+	Running  bool
+}
+
+func readMaintenanceStatus(repo string) maintenanceStatus {
+	d := filepath.Join(repoRoot, repo)
+	st := maintenanceStatus{Repo: repo}
+	st.First, _ = time.Parse(time.RFC3339, gitConfig(d, "coldmine.maintenanceFirst"))
+	st.Time, _ = time.Parse(time.RFC3339, gitConfig(d, "coldmine.maintenanceTime"))
+	st.Duration = gitConfig(d, "coldmine.maintenanceDuration")
+	st.Error = gitConfig(d, "coldmine.maintenanceError")
+	l := lockOf(repo)
+	repoLocks.Lock()
+	st.Pushes, st.Running = l.pushes, l.running
+	repoLocks.Unlock()
+	return st
+}
+
+// maintenanceDue checks the repo should be maintained now.
+func maintenanceDue(st maintenanceStatus) bool {
+	if maintenancePushes > 0 && st.Pushes >= maintenancePushes {
+		return true
+	}
+	if maintenanceInterval <= 0 {
+		return false
+	}
+	if st.Time.IsZero() {
+		return !st.First.IsZero() && !time.Now().Before(st.First)
+	}
+	return time.Since(st.Time) >= maintenanceInterval
+}
+
+// scheduleFirstMaintenance saves when the repo, never maintained, will be maintained first.
+func scheduleFirstMaintenance(repo string) error {
+	if maintenanceInterval <= 0 {
+		return nil
+	}
+	first := time.Now().Add(time.Duration(rand.Int63n(int64(maintenanceInterval))))
+	return setGitConfig(filepath.Join(repoRoot, repo), "coldmine.maintenanceFirst", first.UTC().Format(time.RFC3339))
+}
+
+// maintainRepo runs maintenance tasks in the repo, unless it is being pushed.
+// It reports whether the maintenance is done.
+func maintainRepo(repo string) bool {
+	l := lockOf(repo)
+	if !l.TryLock() {
+		return false
+	}
+	defer l.Unlock()
+	repoLocks.Lock()
+	l.running = true
+	repoLocks.Unlock()
+
+	d := filepath.Join(repoRoot, repo)
+	start := time.Now()
+	var taskErr error
+	for _, args := range maintenanceTasks {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = d
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			taskErr = fmt.Errorf("%v: (%v) %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(string(out)))
+			break
+		}
+	}
+	dur := time.Since(start).Round(time.Millisecond)
+	if taskErr != nil {
+		log.Printf("maintenance of %v failed: %v", repo, taskErr)
+	} else {
+		log.Printf("maintenance of %v done in %v", repo, dur)
+	}
+
+	repoLocks.Lock()
+	l.running = false
+	l.pushes = 0
+	repoLocks.Unlock()
+
+	err := setGitConfig(d, "coldmine.maintenanceTime", start.UTC().Format(time.RFC3339))
+	if err == nil {
+		err = setGitConfig(d, "coldmine.maintenanceDuration", dur.String())
+	}
+	if err == nil {
+		if taskErr != nil {
+			err = setGitConfig(d, "coldmine.maintenanceError", taskErr.Error())
+		} else {
+			err = unsetGitConfig(d, "coldmine.maintenanceError")
+		}
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return true
+}
+
+// allRepos returns names of all repositories, like group/repo.
+func allRepos() ([]string, error) {
+	grps, err := dirScan(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0)
+	for _, g := range grps {
+		for _, r := range g.Repos {
+			repos = append(repos, path.Join(g.Name, r.Name))
+		}
+	}
+	return repos, nil
+}
+
+// runMaintenance checks repositories every minute, and maintains them if needed.
+// Repositories are maintained one by one, not to load the server too much.
+func runMaintenance() {
+	for {
+		time.Sleep(time.Minute)
+		repos, err := allRepos()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		for _, repo := range repos {
+			st := readMaintenanceStatus(repo)
+			if st.Time.IsZero() && st.First.IsZero() {
+				err := scheduleFirstMaintenance(repo)
+				if err != nil {
+					log.Print(err)
+				}
+				st = readMaintenanceStatus(repo)
+			}
+			if maintenanceDue(st) {
+				maintainRepo(repo)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A mirror repository fetches branches and tags of another repository
+// every -mirror-interval, or when requested in its settings page.
+// It could not be pushed. The url is saved in git config of the bare repository,
+// with the time of the last successful sync and the last error if any.
+//
+//	[coldmine]
+//		mirror = https://example.com/repo.git
+//		mirrorTime = 2020-01-02T15:04:05Z
+//		mirrorError = git fetch: exit status 128
+//	[remote "mirror"]
+//		url = https://example.com/repo.git
+//		fetch = +refs/heads/*:refs/heads/*
+//		fetch = +refs/tags/*:refs/tags/*
+var mirrorInterval time.Duration
+
+// scpURLPattern matches scp-like ssh url, like git@example.com:repo.git.
+var scpURLPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+
+// validMirrorURL checks the url could be mirrored.
+// Only file, http(s) and ssh urls are allowed, as other transports
+// like ext:: could run commands in the server.
+func validMirrorURL(url string) error {
+	for _, p := range []string{"file://", "http://", "https://", "ssh://"} {
+		if strings.HasPrefix(url, p) {
+			return nil
+		}
+	}
+	if scpURLPattern.MatchString(url) {
+		return nil
+	}
+	return fmt.Errorf("unsupported mirror url: %v", url)
+}
+
+// repoMirror returns the url the repo mirrors, or empty string if it is not a mirror.
+func repoMirror(repo string) string {
+	return gitConfig(filepath.Join(repoRoot, repo), "coldmine.mirror")
+}
+
+// setupMirror makes the repo a mirror of the url. It does not fetch yet.
+func setupMirror(repo, url string) error {
+	err := validMirrorURL(url)
+	if err != nil {
+		return err
+	}
+	d := filepath.Join(repoRoot, repo)
+	commands := []*exec.Cmd{
+		exec.Command("git", "remote", "add", "mirror", url),
+		exec.Command("git", "config", "remote.mirror.fetch", "+refs/heads/*:refs/heads/*"),
+		exec.Command("git", "config", "--add", "remote.mirror.fetch", "+refs/tags/*:refs/tags/*"),
+		exec.Command("git", "config", "remote.mirror.tagOpt", "--no-tags"),
+		exec.Command("git", "config", "coldmine.mirror", url),
+	}
+	for _, cmd := range commands {
+		cmd.Dir = d
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+		}
+	}
+	return nil
+}
+
+// syncMirror fetches the mirrored repository.
+// It holds the repo lock like a push, so maintenance does not run while fetching.
+func syncMirror(repo string) error {
+	url := repoMirror(repo)
+	if url == "" {
+		return fmt.Errorf("%v is not a mirror", repo)
+	}
+	l := lockOf(repo)
+	repoLocks.Lock()
+	if l.syncing {
+		repoLocks.Unlock()
+		return errors.New("mirror is being synced")
+	}
+	l.syncing = true
+	l.syncTried = time.Now()
+	repoLocks.Unlock()
+	defer func() {
+		repoLocks.Lock()
+		l.syncing = false
+		repoLocks.Unlock()
+	}()
+	defer beginPush(repo)()
+
+	d := filepath.Join(repoRoot, repo)
+	before, err := branchIDs(d)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "-c", "protocol.ext.allow=never", "fetch", "--prune", "--quiet", "mirror")
+	cmd.Dir = d
+	// fetch should fail instead of asking credentials.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("git fetch: (%v) %s", err, strings.TrimSpace(string(out)))
+		if e := setGitConfig(d, "coldmine.mirrorError", err.Error()); e != nil {
+			log.Print(e)
+		}
+		return err
+	}
+	err = setGitConfig(d, "coldmine.mirrorTime", time.Now().UTC().Format(time.RFC3339))
+	if err == nil {
+		err = unsetGitConfig(d, "coldmine.mirrorError")
+	}
+	if err == nil && repoDumbHTTP(repo) {
+		err = updateServerInfo(d)
+	}
+	if err != nil {
+		return err
+	}
+	// fetch runs no hooks, update the review repository like post-receive.
+	after, err := branchIDs(d)
+	if err != nil {
+		return err
+	}
+	updates := make([]refUpdate, 0)
+	for ref, id := range after {
+		if before[ref] != id {
+			old := before[ref]
+			if old == "" {
+				old = zeroID
+			}
+			updates = append(updates, refUpdate{Old: old, New: id, Ref: ref})
+		}
+	}
+	return syncReviewRepo(d, updates)
+}
+
+// branchIDs returns commit ids of the branches in git directory _d_, by their ref names.
+func branchIDs(d string) (map[string]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads/")
+	cmd.Dir = d
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref: %v", err)
+	}
+	ids := make(map[string]string)
+	for _, l := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 2 {
+			ids[f[1]] = f[0]
+		}
+	}
+	return ids, nil
+}
+
+// mirrorSynced returns when the mirror in git directory _d_ was synced,
+// like "5 minutes ago". It returns empty string if it is not a mirror.
+func mirrorSynced(d string) string {
+	if gitConfig(d, "coldmine.mirror") == "" {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, gitConfig(d, "coldmine.mirrorTime"))
+	if err != nil {
+		return "never"
+	}
+	return ago(t)
+}
+
+// ago formats the time relative to now, like git's "%ar".
+func ago(t time.Time) string {
+	d := time.Since(t)
+	n, unit := 0, ""
+	switch {
+	case d < time.Minute:
+		n, unit = int(d/time.Second), "second"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	default:
+		n, unit = int(d/(24*time.Hour)), "day"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%v %v ago", n, unit)
+}
+
+// runMirrors syncs mirrors every -mirror-interval, checking them every minute.
+func runMirrors() {
+	for {
+		time.Sleep(time.Minute)
+		repos, err := allRepos()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		for _, repo := range repos {
+			if repoMirror(repo) == "" {
+				continue
+			}
+			d := filepath.Join(repoRoot, repo)
+			last, _ := time.Parse(time.RFC3339, gitConfig(d, "coldmine.mirrorTime"))
+			l := lockOf(repo)
+			repoLocks.Lock()
+			if l.syncTried.After(last) {
+				// failed syncs are retried after the interval too.
+				last = l.syncTried
+			}
+			repoLocks.Unlock()
+			if time.Since(last) < mirrorInterval {
+				continue
+			}
+			err := syncMirror(repo)
+			if err != nil {
+				log.Printf("could not sync mirror %v: %v", repo, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// pkt-line is the framing of git protocols.
+// Each packet starts with 4 digit hex length including the length itself.
+// Lengths under 4 are special packets without data.
+const (
+	pktMaxLen = 65520
+	// pktMaxData is the max data length of a packet.
+	pktMaxData = pktMaxLen - 4
+)
+
+type pktType int
+
+const (
+	pktData pktType = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+func (t pktType) String() string {
+	switch t {
+	case pktFlush:
+		return "flush"
+	case pktDelim:
+		return "delim"
+	case pktResponseEnd:
+		return "response-end"
+	}
+	return "data"
+}
+
+// side-band channels, used when side-band or side-band-64k capability is on.
+const (
+	sideBandData     = 1
+	sideBandProgress = 2
+	sideBandError    = 3
+)
+
+// pktReader reads packets from git.
+type pktReader struct {
+	r   io.Reader
+	len [4]byte
+}
+
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{r: r}
+}
+
+// read reads a packet. Data of special packets is nil.
+func (p *pktReader) read() (pktType, []byte, error) {
+	_, err := io.ReadFull(p.r, p.len[:])
+	if err != nil {
+		return pktData, nil, err
+	}
+	n, err := strconv.ParseUint(string(p.len[:]), 16, 16)
+	if err != nil {
+		return pktData, nil, fmt.Errorf("invalid packet length: %q", p.len[:])
+	}
+	switch n {
+	case 0:
+		return pktFlush, nil, nil
+	case 1:
+		return pktDelim, nil, nil
+	case 2:
+		return pktResponseEnd, nil, nil
+	case 3:
+		return pktData, nil, fmt.Errorf("invalid packet length: %q", p.len[:])
+	}
+	if n > pktMaxLen {
+		return pktData, nil, fmt.Errorf("packet too long: %v", n)
+	}
+	b := make([]byte, n-4)
+	_, err = io.ReadFull(p.r, b)
+	if err != nil {
+		return pktData, nil, err
+	}
+	if bytes.HasPrefix(b, []byte("ERR ")) {
+		return pktData, b, fmt.Errorf("remote error: %s", bytes.TrimSuffix(b[4:], []byte("\n")))
+	}
+	return pktData, b, nil
+}
+
+// readLine reads a data packet as a text line, without the trailing newline.
+// It returns the type of the packet for special packets.
+func (p *pktReader) readLine() (pktType, string, error) {
+	t, b, err := p.read()
+	if err != nil {
+		return t, "", err
+	}
+	return t, strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// pktWriter writes packets to git.
+type pktWriter struct {
+	w io.Writer
+}
+
+func newPktWriter(w io.Writer) *pktWriter {
+	return &pktWriter{w: w}
+}
+
+func (p *pktWriter) write(b []byte) error {
+	if len(b) > pktMaxData {
+		return errors.New("packet too long")
+	}
+	_, err := fmt.Fprintf(p.w, "%04x", len(b)+4)
+	if err != nil {
+		return err
+	}
+	_, err = p.w.Write(b)
+	return err
+}
+
+// writeLine writes the text as a packet, with a trailing newline.
+func (p *pktWriter) writeLine(format string, a ...interface{}) error {
+	return p.write([]byte(fmt.Sprintf(format, a...) + "\n"))
+}
+
+func (p *pktWriter) flush() error {
+	_, err := io.WriteString(p.w, "0000")
+	return err
+}
+
+func (p *pktWriter) delim() error {
+	_, err := io.WriteString(p.w, "0001")
+	return err
+}
+
+func (p *pktWriter) responseEnd() error {
+	_, err := io.WriteString(p.w, "0002")
+	return err
+}
+
+// writeErr sends an error to the client, which aborts the client.
+// Git shows it as "remote error: <msg>".
+func (p *pktWriter) writeErr(msg string) error {
+	return p.writeLine("ERR %v", msg)
+}
+
+// sideBand returns a writer multiplexing data to the band of side-band-64k.
+// Messages to the progress band are shown as "remote: <msg>" by git.
+func (p *pktWriter) sideBand(band byte) io.Writer {
+	return sideBandWriter{p: p, band: band}
+}
+
+type sideBandWriter struct {
+	p    *pktWriter
+	band byte
+}
+
+func (s sideBandWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		c := b
+		if len(c) > pktMaxData-1 {
+			c = c[:pktMaxData-1]
+		}
+		err := s.p.write(append([]byte{s.band}, c...))
+		if err != nil {
+			return n, err
+		}
+		n += len(c)
+		b = b[len(c):]
+	}
+	return n, nil
+}
+
+// readSideBand reads a multiplexed packet, and returns its band and data.
+func (p *pktReader) readSideBand() (pktType, byte, []byte, error) {
+	t, b, err := p.read()
+	if err != nil || t != pktData {
+		return t, 0, nil, err
+	}
+	if len(b) == 0 {
+		return t, 0, nil, errors.New("empty side-band packet")
+	}
+	return t, b[0], b[1:], nil
+}
+
+// receiveRequest is the beginning of a request to receive-pack.
+type receiveRequest struct {
+	Shallow      []string
+	Updates      []refUpdate
+	Capabilities []string
+	PushOptions  []string
+}
+
+func (r *receiveRequest) capable(c string) bool {
+	for _, rc := range r.Capabilities {
+		if rc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// readReceiveRequest reads ref update commands (and push options if any)
+// of a receive-pack request. The pack follows them is not read.
+func readReceiveRequest(r io.Reader) (*receiveRequest, error) {
+	p := newPktReader(r)
+	req := &receiveRequest{}
+	for {
+		t, l, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if t == pktFlush {
+			break
+		}
+		if t != pktData {
+			return nil, fmt.Errorf("unexpected %v packet in commands", t)
+		}
+		if len(req.Updates) == 0 {
+			// capabilities are sent after NUL of the first command.
+			kv := strings.SplitN(l, "\x00", 2)
+			l = kv[0]
+			if len(kv) == 2 {
+				req.Capabilities = strings.Fields(kv[1])
+			}
+		}
+		if strings.HasPrefix(l, "shallow ") {
+			req.Shallow = append(req.Shallow, strings.TrimPrefix(l, "shallow "))
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid command: %v", l)
+		}
+		req.Updates = append(req.Updates, refUpdate{Old: f[0], New: f[1], Ref: f[2]})
+	}
+	if !req.capable("push-options") {
+		return req, nil
+	}
+	for {
+		t, l, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if t == pktFlush {
+			return req, nil
+		}
+		req.PushOptions = append(req.PushOptions, l)
+	}
+}
+
+// encode writes the request again, for giving it to git.
+// Capabilities are sent with the first command.
+func (r *receiveRequest) encode(w io.Writer) error {
+	p := newPktWriter(w)
+	for _, s := range r.Shallow {
+		err := p.writeLine("shallow %v", s)
+		if err != nil {
+			return err
+		}
+	}
+	for i, u := range r.Updates {
+		l := u.Old + " " + u.New + " " + u.Ref
+		if i == 0 {
+			l += "\x00" + strings.Join(r.Capabilities, " ")
+		}
+		err := p.write([]byte(l + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	err := p.flush()
+	if err != nil || !r.capable("push-options") {
+		return err
+	}
+	for _, o := range r.PushOptions {
+		err := p.write([]byte(o + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+// refReject is an update rejected by coldmine before git receives it.
+type refReject struct {
+	Ref    string
+	Reason string
+}
+
+// writeReceiveStatus writes the status report of a push, which has no update
+// accepted, so git is not run. Only the rejections are reported.
+func writeReceiveStatus(w io.Writer, req *receiveRequest, rejects []refReject) error {
+	if !req.capable("report-status") && !req.capable("report-status-v2") {
+		return nil
+	}
+	report := &bytes.Buffer{}
+	p := newPktWriter(report)
+	p.writeLine("unpack ok")
+	for _, rj := range rejects {
+		p.writeLine("ng %v %v", rj.Ref, rj.Reason)
+	}
+	p.flush()
+	if !req.capable("side-band-64k") {
+		_, err := w.Write(report.Bytes())
+		return err
+	}
+	pw := newPktWriter(w)
+	_, err := pw.sideBand(sideBandData).Write(report.Bytes())
+	if err != nil {
+		return err
+	}
+	return pw.flush()
+}
+
+// injectReceiveStatus copies the output of receive-pack to w,
+// adding the rejections to its status report.
+func injectReceiveStatus(w io.Writer, out io.Reader, req *receiveRequest, rejects []refReject) error {
+	if !req.capable("report-status") && !req.capable("report-status-v2") {
+		_, err := io.Copy(w, out)
+		return err
+	}
+	pr := newPktReader(out)
+	if !req.capable("side-band-64k") {
+		// the output is only the report.
+		report, err := readPackets(pr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(addRejects(report, rejects))
+		return err
+	}
+	// the report is in the data band, while progress messages are sent to other bands.
+	pw := newPktWriter(w)
+	report := &bytes.Buffer{}
+	for {
+		t, band, data, err := pr.readSideBand()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if t == pktFlush {
+			_, err := pw.sideBand(sideBandData).Write(addRejects(report.Bytes(), rejects))
+			if err != nil {
+				return err
+			}
+			return pw.flush()
+		}
+		if band == sideBandData {
+			report.Write(data)
+			continue
+		}
+		err = pw.write(append([]byte{band}, data...))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readPackets reads packets until a flush, then returns them as is.
+func readPackets(pr *pktReader) ([]byte, error) {
+	b := &bytes.Buffer{}
+	pw := newPktWriter(b)
+	for {
+		t, data, err := pr.read()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case pktFlush:
+			pw.flush()
+			return b.Bytes(), nil
+		case pktDelim:
+			pw.delim()
+		case pktResponseEnd:
+			pw.responseEnd()
+		default:
+			pw.write(data)
+		}
+	}
+}
+
+// addRejects adds "ng" lines of the rejections to the end of the status report.
+func addRejects(report []byte, rejects []refReject) []byte {
+	// the report ends with a flush.
+	if !bytes.HasSuffix(report, []byte("0000")) {
+		return report
+	}
+	b := &bytes.Buffer{}
+	b.Write(report[:len(report)-4])
+	p := newPktWriter(b)
+	for _, rj := range rejects {
+		p.writeLine("ng %v %v", rj.Ref, rj.Reason)
+	}
+	p.flush()
+	return b.Bytes()
+}
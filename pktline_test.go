@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const (
+	testOld = "1111111111111111111111111111111111111111"
+	testNew = "2222222222222222222222222222222222222222"
+)
+
+// pushRequest makes a receive-pack request updating the refs to testNew.
+func pushRequest(caps string, refs ...string) []byte {
+	b := &bytes.Buffer{}
+	p := newPktWriter(b)
+	for i, ref := range refs {
+		l := testOld + " " + testNew + " " + ref
+		if i == 0 {
+			l += "\x00" + caps
+		}
+		p.write([]byte(l + "\n"))
+	}
+	p.flush()
+	return b.Bytes()
+}
+
+func TestReadReceiveRequest(t *testing.T) {
+	in := pushRequest("report-status atomic", "refs/heads/master", "refs/tags/v1")
+	req, err := readReceiveRequest(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []refUpdate{
+		{Old: testOld, New: testNew, Ref: "refs/heads/master"},
+		{Old: testOld, New: testNew, Ref: "refs/tags/v1"},
+	}
+	if !reflect.DeepEqual(req.Updates, want) {
+		t.Fatalf("updates: got %v, want %v", req.Updates, want)
+	}
+	if !req.capable("atomic") || req.capable("side-band-64k") {
+		t.Fatalf("unexpected capabilities: %v", req.Capabilities)
+	}
+	out := &bytes.Buffer{}
+	err = req.encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Fatalf("encode: got %q, want %q", out.Bytes(), in)
+	}
+}
+
+func TestWriteReceiveStatus(t *testing.T) {
+	req, err := readReceiveRequest(bytes.NewReader(pushRequest("report-status", "refs/heads/x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	err = writeReceiveStatus(out, req, []refReject{{Ref: "refs/heads/x", Reason: "bad name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "000eunpack ok\n" + "001dng refs/heads/x bad name\n" + "0000"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestWriteReceiveStatusSideBand(t *testing.T) {
+	req, err := readReceiveRequest(bytes.NewReader(pushRequest("report-status side-band-64k", "refs/heads/x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	err = writeReceiveStatus(out, req, []refReject{{Ref: "refs/heads/x", Reason: "bad name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := newPktReader(out)
+	_, band, data, err := pr.readSideBand()
+	if err != nil || band != sideBandData {
+		t.Fatalf("got band %v, %v", band, err)
+	}
+	report, err := readPackets(newPktReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "000eunpack ok\n" + "001dng refs/heads/x bad name\n" + "0000"; string(report) != want {
+		t.Fatalf("got %q, want %q", report, want)
+	}
+	if typ, _, _ := pr.read(); typ != pktFlush {
+		t.Fatalf("should end with flush, got %v", typ)
+	}
+}
+
+func TestAddRejects(t *testing.T) {
+	report := "000eunpack ok\n" + "0018ok refs/heads/ok\n" + "0000"
+	got := addRejects([]byte(report), []refReject{{Ref: "refs/heads/x", Reason: "bad name"}})
+	want := "000eunpack ok\n" + "0018ok refs/heads/ok\n" + "001dng refs/heads/x bad name\n" + "0000"
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
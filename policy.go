@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pushPolicy restricts what could be pushed to a repository.
+// It is saved in git config of the bare repository.
+//
+//	[policy]
+//		maxBlobSize = 10485760
+//		forbiddenPath = *.pem
+//		forbiddenPath = id_rsa
+//		branchPattern = ^(master|feature/.+)$
+//		tagPattern = ^v[0-9]+\.[0-9]+\.[0-9]+$
+//		messagePattern = ^[A-Z].*
+//
+// Names are checked by serviceReceive before git gets the push,
+// contents (blobs and commit messages) are checked by update hook.
+type pushPolicy struct {
+	// MaxBlobSize is the max size of a file in bytes. 0 means no limit.
+	MaxBlobSize int64
+	// ForbiddenPaths are patterns of path.Match, matched with both of
+	// the path and the base name of a file.
+	ForbiddenPaths []string
+	// BranchPattern and TagPattern are regular expressions
+	// the name of a new branch or tag should match.
+	BranchPattern string
+	TagPattern    string
+	// MessagePattern is a regular expression every commit message
+	// should match, except merge commits.
+	MessagePattern string
+}
+
+// readPushPolicy reads push policy from the git directory.
+func readPushPolicy(dir string) (*pushPolicy, error) {
+	cmd := exec.Command("git", "config", "--get-regexp", `^policy\.`)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			// no policy.
+			return &pushPolicy{}, nil
+		}
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	p := &pushPolicy{}
+	for _, l := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		kv := strings.SplitN(l, " ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		// git config returns keys in lower case.
+		switch k, v := kv[0], kv[1]; k {
+		case "policy.maxblobsize":
+			p.MaxBlobSize, _ = strconv.ParseInt(v, 10, 64)
+		case "policy.forbiddenpath":
+			p.ForbiddenPaths = append(p.ForbiddenPaths, v)
+		case "policy.branchpattern":
+			p.BranchPattern = v
+		case "policy.tagpattern":
+			p.TagPattern = v
+		case "policy.messagepattern":
+			p.MessagePattern = v
+		}
+	}
+	return p, nil
+}
+
+func setPushPolicy(repo string, p *pushPolicy) error {
+	if p.MaxBlobSize < 0 {
+		return errors.New("max blob size should not be negative.")
+	}
+	for _, f := range p.ForbiddenPaths {
+		if _, err := path.Match(f, ""); err != nil {
+			return fmt.Errorf("invalid path pattern: %v", f)
+		}
+	}
+	for _, re := range []string{p.BranchPattern, p.TagPattern, p.MessagePattern} {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	d := filepath.Join(repoRoot, repo)
+	cmd := exec.Command("git", "config", "--remove-section", "policy")
+	cmd.Dir = d
+	out, err := cmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "no such section") {
+		return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+	}
+	commands := make([]*exec.Cmd, 0)
+	if p.MaxBlobSize != 0 {
+		commands = append(commands, exec.Command("git", "config", "policy.maxBlobSize", fmt.Sprint(p.MaxBlobSize)))
+	}
+	for _, f := range p.ForbiddenPaths {
+		commands = append(commands, exec.Command("git", "config", "--add", "policy.forbiddenPath", f))
+	}
+	if p.BranchPattern != "" {
+		commands = append(commands, exec.Command("git", "config", "policy.branchPattern", p.BranchPattern))
+	}
+	if p.TagPattern != "" {
+		commands = append(commands, exec.Command("git", "config", "policy.tagPattern", p.TagPattern))
+	}
+	if p.MessagePattern != "" {
+		commands = append(commands, exec.Command("git", "config", "policy.messagePattern", p.MessagePattern))
+	}
+	for _, cmd := range commands {
+		cmd.Dir = d
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+		}
+	}
+	return nil
+}
+
+// checkName checks the name of the updated ref.
+// It returns the reason if the update is rejected, or empty string.
+// Deletions and review branches are always allowed.
+func (p *pushPolicy) checkName(u refUpdate) string {
+	if u.New == zeroID || strings.HasPrefix(u.Ref, "refs/heads/coldmine/review/") {
+		return ""
+	}
+	re, kind, name := "", "", ""
+	switch {
+	case strings.HasPrefix(u.Ref, "refs/heads/"):
+		re, kind, name = p.BranchPattern, "branch", strings.TrimPrefix(u.Ref, "refs/heads/")
+	case strings.HasPrefix(u.Ref, "refs/tags/"):
+		re, kind, name = p.TagPattern, "tag", strings.TrimPrefix(u.Ref, "refs/tags/")
+	}
+	if re == "" {
+		return ""
+	}
+	ok, err := regexp.MatchString(re, name)
+	if err != nil || !ok {
+		return fmt.Sprintf("%v name %v does not match %v", kind, name, re)
+	}
+	return ""
+}
+
+// checkNames checks names of the refs the request updates.
+// It returns the rejections, and the updates git should receive.
+// An atomic push is all or nothing, so any rejection rejects every update of it.
+func (p *pushPolicy) checkNames(req *receiveRequest) ([]refReject, []refUpdate) {
+	rejects := make([]refReject, 0)
+	accepted := make([]refUpdate, 0, len(req.Updates))
+	for _, u := range req.Updates {
+		if reason := p.checkName(u); reason != "" {
+			rejects = append(rejects, refReject{Ref: u.Ref, Reason: reason})
+			continue
+		}
+		accepted = append(accepted, u)
+	}
+	if len(rejects) == 0 || !req.capable("atomic") {
+		return rejects, accepted
+	}
+	for _, u := range accepted {
+		rejects = append(rejects, refReject{Ref: u.Ref, Reason: "atomic push failed"})
+	}
+	return rejects, nil
+}
+
+// checkContent checks files and commit messages newly pushed by the update.
+// It is called in update hook, when the pushed objects are in the quarantine.
+func (p *pushPolicy) checkContent(dir string, u refUpdate) (string, error) {
+	if u.New == zeroID {
+		return "", nil
+	}
+	if p.MaxBlobSize != 0 || len(p.ForbiddenPaths) != 0 {
+		cmd := exec.Command("git", "rev-list", "--objects", u.New, "--not", "--all")
+		cmd.Dir = dir
+		objs, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		cmd = exec.Command("git", "cat-file", "--batch-check=%(objecttype) %(objectsize) %(rest)")
+		cmd.Dir = dir
+		cmd.Stdin = bytes.NewReader(objs)
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			// blob <size> <path>
+			f := strings.SplitN(s.Text(), " ", 3)
+			if len(f) != 3 || f[0] != "blob" {
+				continue
+			}
+			size, _ := strconv.ParseInt(f[1], 10, 64)
+			if p.MaxBlobSize != 0 && size > p.MaxBlobSize {
+				return fmt.Sprintf("file %v is larger than %v bytes", f[2], p.MaxBlobSize), nil
+			}
+			for _, pat := range p.ForbiddenPaths {
+				m1, _ := path.Match(pat, f[2])
+				m2, _ := path.Match(pat, path.Base(f[2]))
+				if m1 || m2 {
+					return fmt.Sprintf("file %v is forbidden by %v", f[2], pat), nil
+				}
+			}
+		}
+	}
+	if p.MessagePattern != "" {
+		re, err := regexp.Compile(p.MessagePattern)
+		if err != nil {
+			return "", err
+		}
+		cmd := exec.Command("git", "log", "-z", "--no-merges", "--format=%H%n%B", u.New, "--not", "--all")
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		for _, c := range strings.Split(string(out), "\x00") {
+			if c == "" {
+				continue
+			}
+			idMsg := strings.SplitN(c, "\n", 2)
+			msg := ""
+			if len(idMsg) == 2 {
+				msg = idMsg[1]
+			}
+			if !re.MatchString(msg) {
+				return fmt.Sprintf("message of commit %v does not match %v", idMsg[0][:8], p.MessagePattern), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkPushPolicy checks the update with push policy of the git directory.
+// It is used by update hook, so a rejection affects only the ref.
+func checkPushPolicy(dir string, u refUpdate) error {
+	p, err := readPushPolicy(dir)
+	if err != nil {
+		return err
+	}
+	reason := p.checkName(u)
+	if reason == "" {
+		reason, err = p.checkContent(dir, u)
+		if err != nil {
+			return err
+		}
+	}
+	if reason != "" {
+		return fmt.Errorf("coldmine: %v: %v", u.Ref, reason)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCheckNames(t *testing.T) {
+	p := &pushPolicy{BranchPattern: "^(master|feature/.+)$"}
+	req, err := readReceiveRequest(bytes.NewReader(pushRequest("report-status", "refs/heads/master", "refs/heads/bad")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects, accepted := p.checkNames(req)
+	wantRejects := []refReject{{Ref: "refs/heads/bad", Reason: "branch name bad does not match ^(master|feature/.+)$"}}
+	if !reflect.DeepEqual(rejects, wantRejects) {
+		t.Fatalf("rejects: got %v, want %v", rejects, wantRejects)
+	}
+	if len(accepted) != 1 || accepted[0].Ref != "refs/heads/master" {
+		t.Fatalf("accepted: got %v", accepted)
+	}
+}
+
+func TestCheckNamesAtomic(t *testing.T) {
+	p := &pushPolicy{BranchPattern: "^(master|feature/.+)$"}
+	req, err := readReceiveRequest(bytes.NewReader(pushRequest("report-status atomic", "refs/heads/master", "refs/heads/bad")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects, accepted := p.checkNames(req)
+	if len(accepted) != 0 {
+		t.Fatalf("atomic push should not update any ref, got %v", accepted)
+	}
+	wantRejects := []refReject{
+		{Ref: "refs/heads/bad", Reason: "branch name bad does not match ^(master|feature/.+)$"},
+		{Ref: "refs/heads/master", Reason: "atomic push failed"},
+	}
+	if !reflect.DeepEqual(rejects, wantRejects) {
+		t.Fatalf("rejects: got %v, want %v", rejects, wantRejects)
+	}
+
+	// nothing is rejected, every ref is updated.
+	req, err = readReceiveRequest(bytes.NewReader(pushRequest("report-status atomic", "refs/heads/master", "refs/heads/feature/x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects, accepted = p.checkNames(req)
+	if len(rejects) != 0 || len(accepted) != 2 {
+		t.Fatalf("got rejects %v, accepted %v", rejects, accepted)
+	}
+}
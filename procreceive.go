@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// procReceiveRefs are refs handled by proc-receive hook, instead of git.
+// Pushes to them create or update reviews, so the refs are not updated as pushed.
+var procReceiveRefs = []string{
+	"refs/heads/coldmine/review/new",
+	"refs/for/",
+}
+
+// procResult is the result of an update handled by proc-receive hook.
+type procResult struct {
+	// Ref is the ref actually updated.
+	Ref string
+	// Old is the old id of Ref, if it is not zero.
+	Old    string
+	Forced bool
+}
+
+// procReceive runs proc-receive hook, which talks with git in pkt-line.
+// See "proc-receive" of githooks(5) for the protocol.
+func procReceive(dir string, in io.Reader, out io.Writer) error {
+	r := newPktReader(in)
+	w := newPktWriter(out)
+
+	// version negotiation, git offers push-options only when the client sent them.
+	offered := false
+	version := ""
+	for {
+		t, l, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if t == pktFlush {
+			break
+		}
+		kv := strings.SplitN(l, "\x00", 2)
+		version = kv[0]
+		if len(kv) == 2 {
+			for _, c := range strings.Fields(kv[1]) {
+				if c == "push-options" {
+					offered = true
+				}
+			}
+		}
+	}
+	if version != "version=1" {
+		return fmt.Errorf("unsupported proc-receive version: %v", version)
+	}
+	l := "version=1"
+	if offered {
+		l += "\x00push-options"
+	}
+	w.writeLine("%v", l)
+	w.flush()
+
+	updates := make([]refUpdate, 0)
+	for {
+		t, l, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if t == pktFlush {
+			break
+		}
+		f := strings.Fields(l)
+		if len(f) != 3 {
+			return fmt.Errorf("invalid proc-receive command: %v", l)
+		}
+		updates = append(updates, refUpdate{Old: f[0], New: f[1], Ref: f[2]})
+	}
+	opts := make(map[string]string)
+	for offered {
+		t, l, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if t == pktFlush {
+			break
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			opts[kv[0]] = kv[1]
+		} else {
+			opts[kv[0]] = ""
+		}
+	}
+
+	for _, u := range updates {
+		var res *procResult
+		var err error
+		if u.New == zeroID {
+			err = fmt.Errorf("could not delete")
+		} else if strings.HasPrefix(u.Ref, "refs/for/") {
+			res, err = receiveForReview(dir, u, opts)
+		} else {
+			res, err = receiveReview(dir, u, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "coldmine: %v: %v\n", u.Ref, err)
+			w.writeLine("ng %v %v", u.Ref, err)
+			continue
+		}
+		w.writeLine("ok %v", u.Ref)
+		w.writeLine("option refname %v", res.Ref)
+		if res.Old != "" {
+			w.writeLine("option old-oid %v", res.Old)
+		}
+		if res.Forced {
+			w.writeLine("option forced-update")
+		}
+	}
+	return w.flush()
+}
+
+// receiveReview creates a review with the pushed commit,
+// and saves it to coldmine/review/<n> branch.
+func receiveReview(dir string, u refUpdate, opts map[string]string) (*procResult, error) {
+	title, err := reviewTitle(dir, u.New, opts)
+	if err != nil {
+		return nil, err
+	}
+	repo := hookRepo(dir)
+	n, err := createReview(repo, title)
+	if err != nil {
+		return nil, err
+	}
+	ref := fmt.Sprintf("refs/heads/coldmine/review/%v", n)
+	err = updateReviewRef(dir, ref, u.New, zeroID)
+	if err != nil {
+		return nil, err
+	}
+	auditReview(repo, "create review", title)
+	printReviewURL(repo, n, "created")
+	return &procResult{Ref: ref}, nil
+}
+
+// receiveForReview handles a push to refs/for/<branch>, like Gerrit and AGit.
+// It updates an open review to the branch having same topic push option
+// or Change-Id trailer with the pushed commit, or creates a new review.
+// Commits of the review are saved in hidden refs/coldmine/review/<n> ref.
+func receiveForReview(dir string, u refUpdate, opts map[string]string) (*procResult, error) {
+	target := strings.TrimPrefix(u.Ref, "refs/for/")
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+target)
+	cmd.Dir = dir
+	if cmd.Run() != nil {
+		return nil, fmt.Errorf("branch %v not exist", target)
+	}
+	change := ""
+	if t := opts["topic"]; t != "" {
+		change = "topic " + t
+	} else {
+		id, err := changeID(dir, u.New)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			change = "Change-Id " + id
+		}
+	}
+	repo := hookRepo(dir)
+	n, err := findOpenReview(repo, target, change)
+	if err != nil {
+		return nil, err
+	}
+	if n != 0 {
+		ref := fmt.Sprintf("refs/coldmine/review/%v", n)
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("review %v is not a pushed review", n)
+		}
+		old := strings.TrimSpace(string(out))
+		err = updateReviewRef(dir, ref, u.New, old)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command("git", "merge-base", "--is-ancestor", old, u.New)
+		cmd.Dir = dir
+		forced := cmd.Run() != nil
+		auditReview(repo, "update review", strconv.Itoa(n))
+		printReviewURL(repo, n, "updated")
+		return &procResult{Ref: ref, Old: old, Forced: forced}, nil
+	}
+	title, err := reviewTitle(dir, u.New, opts)
+	if err != nil {
+		return nil, err
+	}
+	n, err = createReviewFor(repo, title, target, change)
+	if err != nil {
+		return nil, err
+	}
+	ref := fmt.Sprintf("refs/coldmine/review/%v", n)
+	err = updateReviewRef(dir, ref, u.New, zeroID)
+	if err != nil {
+		return nil, err
+	}
+	auditReview(repo, "create review", title)
+	printReviewURL(repo, n, "created")
+	return &procResult{Ref: ref}, nil
+}
+
+// reviewTitle returns the title of a new review, given by review.title
+// push option, or the subject of the pushed commit.
+func reviewTitle(dir, commit string, opts map[string]string) (string, error) {
+	if t := opts["review.title"]; t != "" {
+		return t, nil
+	}
+	cmd := exec.Command("git", "log", "-1", "--format=%s", commit)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not read the commit")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// changeID returns the last Change-Id trailer of the commit, or empty string.
+func changeID(dir, commit string) (string, error) {
+	cmd := exec.Command("git", "log", "-1", "--format=%(trailers:key=Change-Id,valueonly)", commit)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not read the commit")
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[len(ids)-1], nil
+}
+
+func updateReviewRef(dir, ref, new, old string) error {
+	cmd := exec.Command("git", "update-ref", ref, new, old)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not update %v: %s", ref, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func auditReview(repo, action, target string) {
+	writeAudit(auditEntry{
+		Actor:  os.Getenv("COLDMINE_USER"),
+		IP:     os.Getenv("COLDMINE_REMOTE_ADDR"),
+		Action: action,
+		Repo:   repo,
+		Target: target,
+	})
+}
+
+// printReviewURL shows url of the review to the client.
+// It is only the path for ssh pushes, when coldmine is not given -url flag.
+func printReviewURL(repo string, n int, done string) {
+	fmt.Fprintf(os.Stderr, "coldmine: review %v %v: %v\n", n, done, os.Getenv("COLDMINE_URL")+path.Join("/", repo, "review", strconv.Itoa(n)))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// protectRule protects branches matching with Branch pattern.
+// The rules are saved in git config of the bare repository.
+//
+//	[protect "master"]
+//		nopush = true
+//		noforce = true
+//		nodelete = true
+//		pusher = alice
+//		pusher = @devs
+type protectRule struct {
+	Branch string
+	// NoPush allows updating the branch only by merging a review,
+	// or by the pushers.
+	// Pushers without NoPush allows only the pushers, even by merging a review.
+	NoPush   bool
+	NoForce  bool
+	NoDelete bool
+	Pushers  []string
+}
+
+// protectRules reads branch protection rules from the git directory.
+func protectRules(dir string) ([]*protectRule, error) {
+	cmd := exec.Command("git", "config", "--get-regexp", `^protect\.`)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			// no rules.
+			return []*protectRule{}, nil
+		}
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	ruleMap := make(map[string]*protectRule)
+	for _, l := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		// protect.<branch>.<key> <value>
+		kv := strings.SplitN(l, " ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, v := kv[0], kv[1]
+		i, j := strings.Index(k, "."), strings.LastIndex(k, ".")
+		if i == j {
+			continue
+		}
+		b, key := k[i+1:j], k[j+1:]
+		p, ok := ruleMap[b]
+		if !ok {
+			p = &protectRule{Branch: b}
+			ruleMap[b] = p
+		}
+		switch key {
+		case "nopush":
+			p.NoPush = v == "true"
+		case "noforce":
+			p.NoForce = v == "true"
+		case "nodelete":
+			p.NoDelete = v == "true"
+		case "pusher":
+			p.Pushers = append(p.Pushers, v)
+		}
+	}
+	rules := make([]*protectRule, 0, len(ruleMap))
+	for _, p := range ruleMap {
+		rules = append(rules, p)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Branch < rules[j].Branch })
+	return rules, nil
+}
+
+func addProtectRule(repo string, p *protectRule) error {
+	if p.Branch == "" {
+		return errors.New("no branch given.")
+	}
+	if _, err := path.Match(p.Branch, ""); err != nil {
+		return fmt.Errorf("invalid branch pattern: %v", p.Branch)
+	}
+	err := removeProtectRule(repo, p.Branch)
+	if err != nil {
+		return err
+	}
+	sec := "protect." + p.Branch + "."
+	commands := []*exec.Cmd{
+		exec.Command("git", "config", sec+"nopush", fmt.Sprint(p.NoPush)),
+		exec.Command("git", "config", sec+"noforce", fmt.Sprint(p.NoForce)),
+		exec.Command("git", "config", sec+"nodelete", fmt.Sprint(p.NoDelete)),
+	}
+	for _, u := range p.Pushers {
+		commands = append(commands, exec.Command("git", "config", "--add", sec+"pusher", u))
+	}
+	for _, cmd := range commands {
+		cmd.Dir = filepath.Join(repoRoot, repo)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+		}
+	}
+	return nil
+}
+
+// removeProtectRule removes the rule of the branch pattern.
+// It is not an error if the rule does not exist.
+func removeProtectRule(repo, branch string) error {
+	cmd := exec.Command("git", "config", "--remove-section", "protect."+branch)
+	cmd.Dir = filepath.Join(repoRoot, repo)
+	out, err := cmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "no such section") {
+		return fmt.Errorf("%v: (%v) %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
+// checkProtectedBranches checks the updates violate the branch protection rules
+// of the git directory. It is used by pre-receive hook.
+func checkProtectedBranches(dir string, updates []refUpdate) error {
+	rules, err := protectRules(dir)
+	if err != nil {
+		return err
+	}
+	user := os.Getenv("COLDMINE_USER")
+	groups := strings.Split(os.Getenv("COLDMINE_GROUPS"), ",")
+	review := os.Getenv("COLDMINE_REVIEW") != ""
+
+	for _, u := range updates {
+		if !strings.HasPrefix(u.Ref, "refs/heads/") {
+			continue
+		}
+		b := strings.TrimPrefix(u.Ref, "refs/heads/")
+		for _, p := range rules {
+			if ok, _ := path.Match(p.Branch, b); !ok {
+				continue
+			}
+			if u.New == zeroID {
+				if p.NoDelete {
+					return fmt.Errorf("coldmine: branch %v is protected: deletion is not allowed", b)
+				}
+				continue
+			}
+			if p.NoPush && !review && !p.pusher(user, groups) {
+				return fmt.Errorf("coldmine: branch %v is protected: direct push is not allowed, please use a review", b)
+			}
+			if !p.NoPush && len(p.Pushers) != 0 && !p.pusher(user, groups) {
+				return fmt.Errorf("coldmine: branch %v is protected: only allowed pushers could update it", b)
+			}
+			if p.NoForce && u.Old != zeroID {
+				cmd := exec.Command("git", "merge-base", "--is-ancestor", u.Old, u.New)
+				cmd.Dir = dir
+				if cmd.Run() != nil {
+					return fmt.Errorf("coldmine: branch %v is protected: force push is not allowed", b)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// pusher checks the user can push directly to the protected branch.
+func (p *protectRule) pusher(user string, groups []string) bool {
+	if user == "" {
+		return false
+	}
+	for _, s := range p.Pushers {
+		if s == user {
+			return true
+		}
+		for _, g := range groups {
+			if s == "@"+g {
+				return true
+			}
+		}
+	}
+	return false
+}
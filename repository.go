@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -12,9 +11,16 @@ import (
 	"strings"
 )
 
+// reservedNames are used by coldmine web pages.
+// They could not be used as a repository or group name.
+var reservedNames = []string{"users", "login", "logout", "tokens", "keys", "audit", "2fa", "maintenance"}
+
 type repoInfo struct {
 	Name    string
 	Updated string
+	Private bool
+	// Synced is when the mirror synced, or empty if it is not a mirror.
+	Synced string
 }
 
 type repoGroup struct {
@@ -63,7 +69,7 @@ func dirScan(rootp string) ([]*repoGroup, error) {
 			continue
 		}
 		if gitDir(dp) {
-			ng.Repos = append(ng.Repos, repoInfo{Name: fi.Name(), Updated: lastUpdate(dp)})
+			ng.Repos = append(ng.Repos, repoInfo{Name: fi.Name(), Updated: lastUpdate(dp), Private: gitConfig(dp, "coldmine.private") == "true", Synced: mirrorSynced(dp)})
 			continue
 		}
 
@@ -92,7 +98,7 @@ func dirScan(rootp string) ([]*repoGroup, error) {
 				continue
 			}
 			if gitDir(ddp) {
-				g.Repos = append(g.Repos, repoInfo{Name: dfi.Name(), Updated: lastUpdate(ddp)})
+				g.Repos = append(g.Repos, repoInfo{Name: dfi.Name(), Updated: lastUpdate(ddp), Private: gitConfig(ddp, "coldmine.private") == "true", Synced: mirrorSynced(ddp)})
 				continue
 			}
 			return nil, errors.New("max depth reached, but not a git directory: " + ddp)
@@ -147,6 +153,11 @@ func addRepo(repo string) error {
 	if strings.Contains(repo, ".") {
 		return fmt.Errorf("repository name should not have dot(.): %v", repo)
 	}
+	for _, n := range reservedNames {
+		if strings.Split(repo, "/")[0] == n {
+			return fmt.Errorf("repository name is reserved: %v", n)
+		}
+	}
 
 	d := filepath.Join(repoRoot, repo)
 	_, err := os.Stat(d)
@@ -188,30 +199,42 @@ func addRepo(repo string) error {
 		log.Fatalf("review repository setup origin failed: (%v) %v", err, string(out))
 	}
 
-	// setup after-receive hooks, for auto pull to review direcotry.
-	hook := fmt.Sprintf(`#!/bin/bash
-unset $(git rev-parse --local-env-vars)
-while read oldrev newrev refname
-do
-	branch=$(git rev-parse --symbolic --abbrev-ref $refname)
-	cd ../%v
-	if [ "$branch" == "master" ]; then
-		git pull origin master
-	else
-		git fetch origin --update-head-ok $branch
-		git branch -f $branch origin/$branch
-	fi
-	cd $OLDPWD
-done
-`, filepath.Base(rd))
-	err = ioutil.WriteFile(filepath.Join(d, "hooks", "post-receive"), []byte(hook), 0755)
+	err = installHooks(repo)
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = updateServerInfo(filepath.Join(repoRoot, repo))
+	if err != nil {
+		return err
+	}
+	err = applyGitSettings(repo)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// repoPrivate checks the repo is private.
+// Private repository could not be read by anonymous user.
+func repoPrivate(repo string) bool {
+	return gitConfig(filepath.Join(repoRoot, repo), "coldmine.private") == "true"
+}
+
+func setRepoPrivate(repo string, private bool) error {
+	return setGitConfig(filepath.Join(repoRoot, repo), "coldmine.private", fmt.Sprint(private))
+}
+
+// repoDumbHTTP checks the repo could be fetched with dumb http protocol.
+// It is enabled unless disabled in the settings page.
+func repoDumbHTTP(repo string) bool {
+	return gitConfig(filepath.Join(repoRoot, repo), "coldmine.dumbHTTP") != "false"
+}
+
+func setRepoDumbHTTP(repo string, enable bool) error {
+	return setGitConfig(filepath.Join(repoRoot, repo), "coldmine.dumbHTTP", fmt.Sprint(enable))
+}
+
 func removeRepo(repo string) error {
 	if repo == "" {
 		return errors.New("no repository name given.")
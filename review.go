@@ -64,54 +64,143 @@ func listReviews(repo string, n int) []review {
 	return reviews
 }
 
-func createReview(repo, title string) {
-	n := lastReviewNum(repo)
+// createReview creates a new open review of the repo, and returns its number.
+func createReview(repo, title string) (int, error) {
+	err := os.MkdirAll(filepath.Join(reviewRoot, repo), 0755)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		n, err := lastReviewNum(repo)
+		if err != nil {
+			return 0, err
+		}
+		d := filepath.Join(reviewRoot, repo, strconv.Itoa(n)+".open")
+		err = os.Mkdir(d, 0755)
+		if os.IsExist(err) {
+			// another one took the number.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = ioutil.WriteFile(filepath.Join(d, "TITLE"), []byte(title), 0644)
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+}
 
+// createReviewFor creates a new open review, which will be merged to the target branch.
+// change is the key to find the review again when it is pushed with new commits,
+// like "Change-Id I1234..." or "topic parser". Empty change never matches.
+func createReviewFor(repo, title, target, change string) (int, error) {
+	n, err := createReview(repo, title)
+	if err != nil {
+		return 0, err
+	}
 	d := filepath.Join(reviewRoot, repo, strconv.Itoa(n)+".open")
-	err := os.Mkdir(d, 0755)
+	err = ioutil.WriteFile(filepath.Join(d, "TARGET"), []byte(target), 0644)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
+	}
+	err = ioutil.WriteFile(filepath.Join(d, "CHANGE"), []byte(change), 0644)
+	if err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
-	err = ioutil.WriteFile(filepath.Join(d, "TITLE"), []byte(title), 0644)
+// findOpenReview finds an open review of the change to the target branch.
+// It returns 0 if not found.
+func findOpenReview(repo, target, change string) (int, error) {
+	if change == "" {
+		return 0, nil
+	}
+	g, err := filepath.Glob(filepath.Join(reviewRoot, repo, "*.open"))
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
+	for _, d := range g {
+		c, err := ioutil.ReadFile(filepath.Join(d, "CHANGE"))
+		if err != nil || string(c) != change {
+			continue
+		}
+		m := reviewDirPattern.FindStringSubmatch(filepath.Base(d))
+		if len(m) != 3 {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if reviewTarget(repo, n) == target {
+			return n, nil
+		}
+	}
+	return 0, nil
+}
+
+// reviewTarget returns the branch the review will be merged to.
+func reviewTarget(repo string, n int) string {
+	g, _ := filepath.Glob(filepath.Join(reviewRoot, repo, strconv.Itoa(n)+".*", "TARGET"))
+	if len(g) == 0 {
+		return "master"
+	}
+	b, err := ioutil.ReadFile(g[0])
+	if err != nil || len(b) == 0 {
+		return "master"
+	}
+	return string(b)
+}
+
+// reviewRef returns the ref having commits of the review.
+// Reviews pushed to refs/for/<branch> are saved in a hidden ref refs/coldmine/review/<n>,
+// others are saved in coldmine/review/<n> branch.
+// The name is valid both in the repo and its review repo.
+func reviewRef(repo string, n int) string {
+	ref := "refs/coldmine/review/" + strconv.Itoa(n)
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref)
+	cmd.Dir = filepath.Join(repoRoot, repo)
+	if cmd.Run() == nil {
+		return ref
+	}
+	return "coldmine/review/" + strconv.Itoa(n)
 }
 
-func lastReviewNum(repo string) int {
+// lastReviewNum returns the number for a new review of the repo.
+func lastReviewNum(repo string) (int, error) {
 	d := filepath.Join(reviewRoot, repo)
 	f, err := os.Open(d)
 	if err != nil {
-		log.Fatal(err)
+		if os.IsNotExist(err) {
+			return 1, nil
+		}
+		return 0, err
 	}
+	defer f.Close()
 	names, err := f.Readdirnames(-1)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	if len(names) == 0 {
-		return 1
-	}
-	last := -1
+	last := 0
 	for _, n := range names {
 		m := reviewDirPattern.FindStringSubmatch(n)
 		if len(m) != 3 {
-			log.Fatalf("review directory name does not match with naming rule %v: %v", repo, n)
+			return 0, fmt.Errorf("review directory name does not match with naming rule %v: %v", repo, n)
 		}
-		nstr := m[1]
-		n, err := strconv.Atoi(nstr)
+		n, err := strconv.Atoi(m[1])
 		if err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 		if n > last {
 			last = n
 		}
 	}
-	return last + 1
+	return last + 1, nil
 }
 
 // mergeReview merges nth review of the repo to some branch.
-func mergeReview(repo string, n int, b, toB string) {
+// The user is who requested the merge.
+func mergeReview(repo string, n int, b, toB, user string) {
 	d := filepath.Join(reviewRoot, repo, strconv.Itoa(n)+".open")
 	_, err := os.Stat(d)
 	if os.IsNotExist(err) {
@@ -128,6 +217,8 @@ func mergeReview(repo string, n int, b, toB string) {
 	var m = &sync.Mutex{}
 	m.Lock()
 	defer m.Unlock()
+	// merging pushes to the repo.
+	defer beginPush(repo)()
 
 	rd := filepath.Join(repoRoot, repo+".r")
 	// restore original HEAD branch after merge it.
@@ -149,6 +240,8 @@ func mergeReview(repo string, n int, b, toB string) {
 	}
 	for _, cmd := range commands {
 		cmd.Dir = rd
+		// let the hooks know it is merging a review.
+		cmd.Env = append(hookEnv(user, ""), "COLDMINE_REVIEW="+strconv.Itoa(n))
 		out, err = cmd.CombinedOutput()
 		if err != nil {
 			log.Fatalf("%v: (%v) %s", cmd, err, out)
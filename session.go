@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "coldmine_session"
+	sessionMaxAge = 7 * 24 * time.Hour
+	pendingMaxAge = 5 * time.Minute
+)
+
+// sessionKey signs session cookies and csrf tokens.
+// It is saved in 'session_key' file, so sessions survive restart of coldmine.
+var sessionKey []byte
+
+// initSessionKey reads the session key. If not exist, it will create a new one.
+func initSessionKey() error {
+	b, err := ioutil.ReadFile("session_key")
+	if err == nil {
+		if len(b) < 32 {
+			return errors.New("session_key file is too short. remove it to generate again.")
+		}
+		sessionKey = b
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	b = make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile("session_key", b, 0600)
+	if err != nil {
+		return err
+	}
+	sessionKey = b
+	return nil
+}
+
+func sign(s string) string {
+	m := hmac.New(sha256.New, sessionKey)
+	m.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// setSession makes a signed session cookie for the user.
+// The cookie value is "<user>|<expire>|<nonce>|<epoch>" and its signature.
+func setSession(w http.ResponseWriter, r *http.Request, user string) error {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	expire := time.Now().Add(sessionMaxAge)
+	v := user + "|" + strconv.FormatInt(expire.Unix(), 10) + "|" + base64.RawURLEncoding.EncodeToString(nonce) + "|" + sessionEpoch(user)
+	v = base64.RawURLEncoding.EncodeToString([]byte(v))
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    v + "." + sign(v),
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// pendingLogin returns a token of the user who passed the password,
+// but not yet the second factor. It is valid for a few minutes.
+func pendingLogin(user string) string {
+	v := user + "|" + strconv.FormatInt(time.Now().Add(pendingMaxAge).Unix(), 10)
+	v = base64.RawURLEncoding.EncodeToString([]byte(v))
+	return v + "." + sign("pending|"+v)
+}
+
+// pendingUser returns the user of the pending login token,
+// or empty string if it is not valid.
+func pendingUser(token string) string {
+	vs := strings.Split(token, ".")
+	if len(vs) != 2 || !hmac.Equal([]byte(sign("pending|"+vs[0])), []byte(vs[1])) {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(vs[0])
+	if err != nil {
+		return ""
+	}
+	fs := strings.Split(string(b), "|")
+	if len(fs) != 2 {
+		return ""
+	}
+	expire, err := strconv.ParseInt(fs[1], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return ""
+	}
+	return fs[0]
+}
+
+// sessionUser returns the logged in user of the request.
+// It returns empty string when the session is not valid,
+// or the user is removed or disabled after logged in.
+func sessionUser(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	vs := strings.Split(c.Value, ".")
+	if len(vs) != 2 || !hmac.Equal([]byte(sign(vs[0])), []byte(vs[1])) {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(vs[0])
+	if err != nil {
+		return ""
+	}
+	fs := strings.Split(string(b), "|")
+	if len(fs) != 4 {
+		return ""
+	}
+	expire, err := strconv.ParseInt(fs[1], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return ""
+	}
+	user := fs[0]
+	if !userExist(user) || userDisabled(user) || fs[3] != sessionEpoch(user) {
+		return ""
+	}
+	return user
+}
+
+// sessionEpoch returns the session epoch of the user, saved in SESSION file
+// of the user directory. Sessions made with an old epoch are not valid,
+// as the cookie itself is valid until it expires.
+func sessionEpoch(user string) string {
+	b, err := ioutil.ReadFile(filepath.Join(userRoot, user, "SESSION"))
+	if err != nil {
+		return "0"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// endSessions makes every session of the user invalid.
+func endSessions(user string) error {
+	n, _ := strconv.Atoi(sessionEpoch(user))
+	return ioutil.WriteFile(filepath.Join(userRoot, user, "SESSION"), []byte(strconv.Itoa(n+1)+"\n"), 0600)
+}
+
+// csrfToken returns a token bound to the session of the request.
+// Every form making changes should send it back as "csrf" field.
+func csrfToken(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return sign("csrf|" + c.Value)
+}
+
+// pageSession is embedded in data of every page,
+// top.html shows the user and the logout form with it.
+type pageSession struct {
+	User string
+	CSRF string
+}
+
+// Admin checks the logged in user is an admin,
+// top.html shows links to admin pages with it.
+func (s pageSession) Admin() bool {
+	return s.User != "" && userAdmin(s.User)
+}
+
+// sessionInfo returns the logged in user and the csrf token,
+// which are needed to render a page.
+func sessionInfo(r *http.Request) (string, string) {
+	u := sessionUser(r)
+	if u == "" {
+		return "", ""
+	}
+	return u, csrfToken(r)
+}
+
+// actionUser checks the session and the csrf token of a form submission.
+// It returns the user name if they are valid.
+func actionUser(r *http.Request) (string, bool) {
+	r.ParseForm()
+	u := sessionUser(r)
+	if u == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(r.Form.Get("csrf")), []byte(csrfToken(r))) {
+		return "", false
+	}
+	return u, true
+}
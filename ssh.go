@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKey is a public key in authorized_keys file of the user directory.
+type sshKey struct {
+	Fingerprint string
+	Type        string
+	Comment     string
+	key         ssh.PublicKey
+}
+
+func listSSHKeys(user string) ([]*sshKey, error) {
+	b, err := ioutil.ReadFile(filepath.Join(userRoot, user, "authorized_keys"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*sshKey{}, nil
+		}
+		return nil, err
+	}
+	keys := make([]*sshKey, 0)
+	for len(b) != 0 {
+		k, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			// no more valid key.
+			break
+		}
+		keys = append(keys, &sshKey{Fingerprint: ssh.FingerprintSHA256(k), Type: k.Type(), Comment: comment, key: k})
+		b = rest
+	}
+	return keys, nil
+}
+
+func writeSSHKeys(user string, keys []*sshKey) error {
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		l := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(k.key)), "\n")
+		if k.Comment != "" {
+			l += " " + k.Comment
+		}
+		lines = append(lines, l+"\n")
+	}
+	return ioutil.WriteFile(filepath.Join(userRoot, user, "authorized_keys"), []byte(strings.Join(lines, "")), 0600)
+}
+
+// addSSHKey adds a public key line (as in authorized_keys) to the user.
+// A key could be used only by one user.
+func addSSHKey(user, line string) error {
+	if !userExist(user) {
+		return fmt.Errorf("user not exist: %v", user)
+	}
+	k, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	if u := sshKeyUser(k); u != "" {
+		return fmt.Errorf("the key is already used by %v", u)
+	}
+	keys, err := listSSHKeys(user)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, &sshKey{Fingerprint: ssh.FingerprintSHA256(k), Type: k.Type(), Comment: comment, key: k})
+	return writeSSHKeys(user, keys)
+}
+
+func removeSSHKey(user, fingerprint string) error {
+	keys, err := listSSHKeys(user)
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if k.Fingerprint == fingerprint {
+			return writeSSHKeys(user, append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return fmt.Errorf("key not exist: %v", fingerprint)
+}
+
+// sshKeyUser finds the user who has the key.
+// It returns empty string if no one has it.
+func sshKeyUser(key ssh.PublicKey) string {
+	users, err := listUsers()
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	fp := ssh.FingerprintSHA256(key)
+	for _, u := range users {
+		keys, err := listSSHKeys(u.Name)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		for _, k := range keys {
+			if k.Fingerprint == fp {
+				return u.Name
+			}
+		}
+	}
+	return ""
+}
+
+// sshHostKey reads the host key from 'ssh_host_key' file.
+// If not exist, it will create a new ed25519 key.
+func sshHostKey() (ssh.Signer, error) {
+	b, err := ioutil.ReadFile("ssh_host_key")
+	if err == nil {
+		return ssh.ParsePrivateKey(b)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := ssh.MarshalPrivateKey(priv, "coldmine")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile("ssh_host_key", pem.EncodeToMemory(blk), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(priv)
+}
+
+// serveSSH serves git over ssh. Users are authenticated by their public keys,
+// the user name of ssh connection is not used.
+func serveSSH(addr string) error {
+	hostKey, err := sshHostKey()
+	if err != nil {
+		return fmt.Errorf("could not load ssh host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			u := sshKeyUser(key)
+			if u == "" || userDisabled(u) {
+				return nil, fmt.Errorf("unknown public key for %v", c.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"user": u}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("ssh binding to %v", addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSSHConn(c, config)
+	}
+}
+
+func handleSSHConn(c net.Conn, config *ssh.ServerConfig) {
+	defer c.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		log.Printf("ssh handshake failed from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	user := conn.Permissions.Extensions["user"]
+	ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go handleSSHSession(ch, chReqs, user, ip)
+	}
+}
+
+// handleSSHSession runs a git command requested by "exec" request.
+// Only git-upload-pack and git-receive-pack are allowed.
+func handleSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request, user, ip string) {
+	defer ch.Close()
+	env := make([]string, 0)
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			// git sends protocol version with GIT_PROTOCOL.
+			var kv struct{ Name, Value string }
+			if ssh.Unmarshal(req.Payload, &kv) == nil && kv.Name == "GIT_PROTOCOL" {
+				if p := validGitProtocol(kv.Value); p != "" {
+					env = append(env, "GIT_PROTOCOL="+p)
+				}
+				req.Reply(true, nil)
+				continue
+			}
+			req.Reply(false, nil)
+		case "exec":
+			var cmdline struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &cmdline) != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			status := runSSHCommand(ch, user, ip, cmdline.Command, env)
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, status)
+			ch.SendRequest("exit-status", false, b)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runSSHCommand runs the git command, then returns the exit status.
+// Messages to the user are written to stderr of the channel.
+func runSSHCommand(ch ssh.Channel, user, ip, command string, env []string) uint32 {
+	c := strings.SplitN(command, " ", 2)
+	if len(c) != 2 || (c[0] != "git-upload-pack" && c[0] != "git-receive-pack") {
+		fmt.Fprintf(ch.Stderr(), "coldmine: unsupported command: %v\n", command)
+		return 1
+	}
+	// repository path is quoted by git, like 'group/repo'.
+	p := strings.Trim(strings.Trim(c[1], "'\""), "/")
+	if path.Clean("/"+p) != "/"+p || strings.Contains(p, "..") {
+		fmt.Fprintf(ch.Stderr(), "coldmine: invalid repository path: %v\n", p)
+		return 1
+	}
+	repo, subpath := splitURLPath("/" + p)
+	if repo == "" || subpath != "" {
+		fmt.Fprintf(ch.Stderr(), "coldmine: repository not found: %v\n", p)
+		return 1
+	}
+	need := permRead
+	if c[0] == "git-receive-pack" {
+		need = permWrite
+	}
+	if repoPerm(user, repo) < need {
+		fmt.Fprintf(ch.Stderr(), "coldmine: %v has no permission to %v\n", user, repo)
+		return 1
+	}
+	if c[0] == "git-receive-pack" {
+		log.Printf("push to %v by %v (ssh)", repo, user)
+		defer beginPush(repo)()
+	}
+
+	cmd := exec.Command("git", strings.TrimPrefix(c[0], "git-"), filepath.Join(repoRoot, repo))
+	cmd.Env = append(hookEnv(user, ip), env...)
+	if baseURL != "" {
+		// hooks show urls of web pages with it, only the path is shown without it.
+		cmd.Env = append(cmd.Env, "COLDMINE_URL="+strings.TrimSuffix(baseURL, "/"))
+	}
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	err = cmd.Start()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	go func() {
+		io.Copy(in, ch)
+		in.Close()
+	}()
+	err = cmd.Wait()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return uint32(e.ExitCode())
+		}
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// sshRemote returns ssh url of the repo, or empty string if ssh is not served.
+func sshRemote(host, repo string) string {
+	if sshAddr == "" {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(sshAddr)
+	if err != nil {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("ssh://git@%v:%v/%v", host, port, repo)
+}
@@ -41,7 +41,23 @@ var (
 			return strings.TrimRight(strings.Split(l, " ")[1], "\n")
 		},
 	}
-	reviewTmpl = template.Must(template.New("review.html").Funcs(reviewFmap).ParseFiles("review.html", "head.html", "top.html"))
+	reviewTmpl    = template.Must(template.New("review.html").Funcs(reviewFmap).ParseFiles("review.html", "head.html", "top.html"))
+	usersTmpl     = template.Must(template.ParseFiles("users.html", "head.html", "top.html"))
+	settingsTmpl  = template.Must(template.ParseFiles("settings.html", "head.html", "top.html"))
+	loginTmpl     = template.Must(template.ParseFiles("login.html", "head.html", "top.html"))
+	tokensTmpl    = template.Must(template.ParseFiles("tokens.html", "head.html", "top.html"))
+	keysTmpl      = template.Must(template.ParseFiles("keys.html", "head.html", "top.html"))
+	twoFactorTmpl = template.Must(template.ParseFiles("twofactor.html", "head.html", "top.html"))
+	auditFmap     = template.FuncMap{
+		"shortID": func(id string) string {
+			if len(id) > 8 {
+				return id[:8]
+			}
+			return id
+		},
+	}
+	auditTmpl       = template.Must(template.New("audit.html").Funcs(auditFmap).ParseFiles("audit.html", "head.html", "top.html"))
+	maintenanceTmpl = template.Must(template.ParseFiles("maintenance.html", "head.html", "top.html"))
 )
 
 // treeEl holds information to draw each tree element.
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// failures allowed before locking out.
+	throttleFree = 5
+	// lock out period doubles from throttleBase for every failure after that,
+	// until it reaches throttleMax.
+	throttleBase = time.Second
+	throttleMax  = 15 * time.Minute
+	// failures are forgotten after this period without a new failure.
+	throttleForget = time.Hour
+)
+
+type failure struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// throttle tracks authentication failures by key,
+// which is "ip:<addr>" or "user:<name>".
+type throttle struct {
+	sync.Mutex
+	failures map[string]*failure
+}
+
+var authThrottle = &throttle{failures: make(map[string]*failure)}
+
+// locked checks the key is locked out now.
+func (t *throttle) locked(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+	f, ok := t.failures[key]
+	return ok && time.Now().Before(f.until)
+}
+
+func (t *throttle) fail(key string) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for k, f := range t.failures {
+		if now.Sub(f.last) > throttleForget {
+			delete(t.failures, k)
+		}
+	}
+	f, ok := t.failures[key]
+	if !ok {
+		f = &failure{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count <= throttleFree {
+		return
+	}
+	d := throttleMax
+	if n := uint(f.count - throttleFree - 1); n < 20 {
+		d = throttleBase << n
+		if d > throttleMax {
+			d = throttleMax
+		}
+	}
+	f.until = now.Add(d)
+	log.Printf("lockout %v for %v after %v failures", key, d, f.count)
+}
+
+func (t *throttle) reset(key string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.failures, key)
+}
+
+func remoteIP(r *http.Request) string {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return h
+}
+
+// authAllowed checks neither the request's ip nor the user is locked out.
+// Every authentication with a password or token should check it first,
+// then report the result with authResult.
+func authAllowed(r *http.Request, user string) bool {
+	return !authThrottle.locked("ip:"+remoteIP(r)) && !authThrottle.locked("user:"+user)
+}
+
+func authResult(r *http.Request, user string, ok bool) {
+	if ok {
+		authThrottle.reset("ip:" + remoteIP(r))
+		authThrottle.reset("user:" + user)
+		return
+	}
+	authThrottle.fail("ip:" + remoteIP(r))
+	if user != "" {
+		authThrottle.fail("user:" + user)
+	}
+}
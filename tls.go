@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certLoader holds the certificate for https.
+// It reloads the certificate files when coldmine gets SIGHUP,
+// so renewed certificate is used without restart.
+type certLoader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func (c *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert = &cert
+	c.Unlock()
+	return nil
+}
+
+func (c *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certLoader) reloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := c.load()
+		if err != nil {
+			log.Printf("could not reload certificate: %v", err)
+			continue
+		}
+		log.Print("certificate reloaded")
+	}
+}
+
+// generateCert makes a self-signed certificate and its key,
+// for localhost and the host name of this machine. It is valid for a year.
+func generateCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"coldmine"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if h, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, h)
+	}
+	if h, _, err := net.SplitHostPort(ipAddr); err == nil && h != "" {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// listenAndServeTLS serves https with the certificate files.
+// When selfSigned is true and the files do not exist, they are generated first.
+func listenAndServeTLS(addr, certFile, keyFile string, selfSigned bool) error {
+	if selfSigned {
+		_, err := os.Stat(certFile)
+		if os.IsNotExist(err) {
+			log.Printf("generating self-signed certificate: %v", certFile)
+			err = generateCert(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c := &certLoader{certFile: certFile, keyFile: keyFile}
+	err := c.load()
+	if err != nil {
+		return err
+	}
+	go c.reloadOnSIGHUP()
+	srv := &http.Server{
+		Addr:      addr,
+		TLSConfig: &tls.Config{GetCertificate: c.getCertificate, MinVersion: tls.VersionTLS12},
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS redirects every request to https address of coldmine.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(ipAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
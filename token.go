@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenPrefix is prefix of every access token,
+// so it is distinguishable from a password.
+const tokenPrefix = "cm_"
+
+// accessToken lets a user use git without the password.
+// Only hash of the token is saved in TOKENS file of the user directory,
+// one token per line.
+//
+//	<id> <hash> <scope> <repo> <expire> <name>
+type accessToken struct {
+	ID     string
+	Hash   string
+	Scope  perm   // permRead or permWrite
+	Repo   string // "*" means every repository.
+	Expire int64  // unix time, 0 means never.
+	Name   string
+}
+
+func (t *accessToken) Expired() bool {
+	return t.Expire != 0 && time.Now().Unix() > t.Expire
+}
+
+func (t *accessToken) ExpireDate() string {
+	if t.Expire == 0 {
+		return "never"
+	}
+	return time.Unix(t.Expire, 0).Format("2006-01-02")
+}
+
+// limit limits the permission p of the repo with the token's scope.
+func (t *accessToken) limit(repo string, p perm) perm {
+	if t.Repo != "*" && t.Repo != repo {
+		return permNone
+	}
+	if p > t.Scope {
+		return t.Scope
+	}
+	return p
+}
+
+func tokenHash(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
+
+func listTokens(user string) ([]*accessToken, error) {
+	f, err := os.Open(filepath.Join(userRoot, user, "TOKENS"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*accessToken{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	toks := make([]*accessToken, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.SplitN(s.Text(), " ", 6)
+		if len(l) != 6 {
+			return nil, fmt.Errorf("invalid token line of %v: %v", user, s.Text())
+		}
+		expire, err := strconv.ParseInt(l[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token expire of %v: %v", user, l[4])
+		}
+		toks = append(toks, &accessToken{ID: l[0], Hash: l[1], Scope: permNames[l[2]], Repo: l[3], Expire: expire, Name: l[5]})
+	}
+	return toks, s.Err()
+}
+
+func writeTokens(user string, toks []*accessToken) error {
+	lines := make([]string, 0, len(toks))
+	for _, t := range toks {
+		lines = append(lines, fmt.Sprintf("%v %v %v %v %v %v\n", t.ID, t.Hash, t.Scope, t.Repo, t.Expire, t.Name))
+	}
+	return ioutil.WriteFile(filepath.Join(userRoot, user, "TOKENS"), []byte(strings.Join(lines, "")), 0600)
+}
+
+// createToken creates a new token of the user. days is valid period of the token,
+// 0 means it will not expire. It returns the token which is not saved anywhere.
+func createToken(user, name string, scope perm, repo string, days int) (string, error) {
+	if !userExist(user) {
+		return "", fmt.Errorf("user not exist: %v", user)
+	}
+	if scope != permRead && scope != permWrite {
+		return "", errors.New("token scope should read or write.")
+	}
+	if repo == "" {
+		repo = "*"
+	}
+	if strings.ContainsAny(repo, " \n") || strings.Contains(name, "\n") {
+		return "", errors.New("invalid token repo or name.")
+	}
+	if days < 0 {
+		return "", errors.New("token expire days should not negative.")
+	}
+	toks, err := listTokens(user)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 24)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	tok := tokenPrefix + hex.EncodeToString(b)
+	h := tokenHash(tok)
+	var expire int64
+	if days != 0 {
+		expire = time.Now().AddDate(0, 0, days).Unix()
+	}
+	toks = append(toks, &accessToken{ID: h[:8], Hash: h, Scope: scope, Repo: repo, Expire: expire, Name: name})
+	err = writeTokens(user, toks)
+	if err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+func revokeToken(user, id string) error {
+	toks, err := listTokens(user)
+	if err != nil {
+		return err
+	}
+	for i, t := range toks {
+		if t.ID == id {
+			return writeTokens(user, append(toks[:i], toks[i+1:]...))
+		}
+	}
+	return fmt.Errorf("token not exist: %v", id)
+}
+
+// checkToken finds the user's token matched with tok.
+// It returns nil when the user is disabled, or the token is not valid.
+func checkToken(user, tok string) *accessToken {
+	if !userExist(user) || userDisabled(user) {
+		return nil
+	}
+	toks, err := listTokens(user)
+	if err != nil {
+		return nil
+	}
+	h := tokenHash(tok)
+	for _, t := range toks {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(h)) == 1 && !t.Expired() {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP (RFC 6238) parameters, which authenticator apps use by default.
+// Codes are 6 digits.
+const (
+	totpPeriod = 30
+	// codes of a step before or after are accepted too, for clock skew.
+	totpSkew = 1
+)
+
+// recoveryCodes is the number of recovery codes made at enrollment.
+const recoveryCodes = 10
+
+// totpEnrollMaxAge is how long a secret shown in the enrollment page could be enabled.
+const totpEnrollMaxAge = 10 * time.Minute
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpUsed holds the last step used by each user,
+// so a code could not be used twice.
+var totpUsed = struct {
+	sync.Mutex
+	step map[string]int64
+}{step: make(map[string]int64)}
+
+// TOTP file in the user directory holds the base32 secret of TOTP,
+// it exists only when two-factor authentication is enabled.
+// RECOVERY file holds sha256 hashes of unused recovery codes.
+func totpEnabled(user string) bool {
+	_, err := os.Stat(filepath.Join(userRoot, user, "TOTP"))
+	return err == nil
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURL returns otpauth url of the secret, which is shown as a QR code.
+func totpURL(user, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", "coldmine")
+	return "otpauth://totp/" + url.PathEscape("coldmine:"+user) + "?" + v.Encode()
+}
+
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	m := hmac.New(sha1.New, key)
+	m.Write(msg)
+	sum := m.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// validTOTP checks the code is valid for the secret now,
+// and returns its step.
+func validTOTP(secret, code string) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for s := now - totpSkew; s <= now+totpSkew; s++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// signTOTPSecret signs the secret shown to the user in the enrollment page,
+// with its expiry, like "<expire>.<signature>".
+func signTOTPSecret(user, secret string) string {
+	expire := strconv.FormatInt(time.Now().Add(totpEnrollMaxAge).Unix(), 10)
+	return expire + "." + sign("totp|"+user+"|"+secret+"|"+expire)
+}
+
+// validTOTPSecretSig checks the secret is the one signed for the user, and not expired.
+func validTOTPSecretSig(user, secret, sig string) bool {
+	vs := strings.SplitN(sig, ".", 2)
+	if len(vs) != 2 || !hmac.Equal([]byte(sign("totp|"+user+"|"+secret+"|"+vs[0])), []byte(vs[1])) {
+		return false
+	}
+	expire, err := strconv.ParseInt(vs[0], 10, 64)
+	return err == nil && time.Now().Unix() <= expire
+}
+
+// enableTOTP saves the secret after the user entered a valid code of it,
+// then returns new recovery codes.
+// It fails when it is already enabled, it should be disabled with the current code first.
+func enableTOTP(user, secret, code string) ([]string, error) {
+	if totpEnabled(user) {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if _, ok := validTOTP(secret, code); !ok {
+		return nil, fmt.Errorf("invalid code, please check the time of your device")
+	}
+	err := ioutil.WriteFile(filepath.Join(userRoot, user, "TOTP"), []byte(secret+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newRecoveryCodes(user)
+}
+
+func disableTOTP(user string) error {
+	for _, f := range []string{"TOTP", "RECOVERY"} {
+		err := os.Remove(filepath.Join(userRoot, user, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRecoveryCodes makes new recovery codes of the user, old ones are dropped.
+// Only hashes of them are saved, so they are shown to the user only once.
+func newRecoveryCodes(user string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	hashes := ""
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c := hex.EncodeToString(b)
+		c = c[:5] + "-" + c[5:]
+		codes = append(codes, c)
+		hashes += recoveryHash(c) + "\n"
+	}
+	err := ioutil.WriteFile(filepath.Join(userRoot, user, "RECOVERY"), []byte(hashes), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func recoveryHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor checks a TOTP code or a recovery code of the user.
+// A used recovery code is removed.
+func checkSecondFactor(user, code string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(userRoot, user, "TOTP"))
+	if err != nil {
+		return false
+	}
+	if step, ok := validTOTP(strings.TrimSpace(string(b)), code); ok {
+		totpUsed.Lock()
+		defer totpUsed.Unlock()
+		if step <= totpUsed.step[user] {
+			return false
+		}
+		totpUsed.step[user] = step
+		return true
+	}
+
+	f := filepath.Join(userRoot, user, "RECOVERY")
+	b, err = ioutil.ReadFile(f)
+	if err != nil {
+		return false
+	}
+	h := recoveryHash(code)
+	hashes := strings.Fields(string(b))
+	for i, rh := range hashes {
+		if subtle.ConstantTimeCompare([]byte(rh), []byte(h)) == 1 {
+			rest := append(hashes[:i], hashes[i+1:]...)
+			err := ioutil.WriteFile(f, []byte(strings.Join(append(rest, ""), "\n")), 0600)
+			return err == nil
+		}
+	}
+	return false
+}
+
+// recoveryLeft returns the number of unused recovery codes of the user.
+func recoveryLeft(user string) int {
+	b, err := ioutil.ReadFile(filepath.Join(userRoot, user, "RECOVERY"))
+	if err != nil {
+		return 0
+	}
+	return len(strings.Fields(string(b)))
+}
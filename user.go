@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var userNamePattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9_-]*$")
+
+// dummyHash is compared when the user does not exist,
+// so the response time doesn't tell whether the user exists.
+// It is made at the first use, as hook processes never check passwords.
+var dummyHash struct {
+	sync.Once
+	hash []byte
+}
+
+// compareDummyHash takes same time with checking a password.
+func compareDummyHash(passwd string) {
+	dummyHash.Do(func() {
+		h, err := bcrypt.GenerateFromPassword([]byte("coldmine"), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("could not make dummy hash: %v", err)
+			return
+		}
+		dummyHash.hash = h
+	})
+	if dummyHash.hash != nil {
+		bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(passwd))
+	}
+}
+
+// user data is saved in a directory named after the user, under userRoot.
+// PASSWORD file holds bcrypt hash of the password,
+// DISABLED file exists only when the user is disabled,
+// ADMIN file exists only when the user is an admin.
+// SESSION file holds the session epoch, see sessionEpoch.
+type user struct {
+	Name     string
+	Disabled bool
+	Admin    bool
+}
+
+// initUsers makes the user data directory.
+// If there is no user yet and the users are authenticated locally,
+// it will create "coldmine" admin user with the password written in 'password' file.
+func initUsers() error {
+	err := os.MkdirAll(userRoot, 0755)
+	if err != nil {
+		return err
+	}
+	users, err := listUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) != 0 {
+		if hasAdmin() {
+			return nil
+		}
+		if firstAdmin != "" && userExist(firstAdmin) {
+			log.Printf("no admin user, making %v an admin as -admin flag", firstAdmin)
+			return setUserAdmin(firstAdmin, true)
+		}
+		if _, local := authenticator.(localAuth); !local {
+			// 'coldmine' could be anyone in the external backend.
+			log.Print("no admin user, please give -admin flag to make one")
+			return nil
+		}
+		if !userExist("coldmine") {
+			return nil
+		}
+		// users made before admin role, keep the first user as an admin.
+		log.Print("no admin user, making 'coldmine' an admin")
+		return setUserAdmin("coldmine", true)
+	}
+	if _, local := authenticator.(localAuth); !local {
+		// users will be added at their first login.
+		// the admin named by -admin flag will be set then.
+		if firstAdmin == "" {
+			log.Print("no admin user, please give -admin flag to make one")
+		}
+		return nil
+	}
+	b, err := ioutil.ReadFile("password")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("please make 'password' file with your password. it will be used as password of 'coldmine' user.")
+		}
+		return fmt.Errorf("open password error: %v", err)
+	}
+	passwd := strings.Split(string(b), "\n")[0]
+	if passwd == "" {
+		return errors.New("password file should not empty (need password).")
+	}
+	err = addUser("coldmine", passwd)
+	if err != nil {
+		return err
+	}
+	return setUserAdmin("coldmine", true)
+}
+
+func listUsers() ([]user, error) {
+	f, err := os.Open(userRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	users := make([]user, 0, len(names))
+	for _, n := range names {
+		if !userExist(n) {
+			continue
+		}
+		users = append(users, user{Name: n, Disabled: userDisabled(n), Admin: userAdmin(n)})
+	}
+	return users, nil
+}
+
+func userExist(name string) bool {
+	if !userNamePattern.MatchString(name) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(userRoot, name, "PASSWORD"))
+	return err == nil
+}
+
+func userDisabled(name string) bool {
+	_, err := os.Stat(filepath.Join(userRoot, name, "DISABLED"))
+	return err == nil
+}
+
+// userAdmin checks the user is an enabled admin.
+// Admins could add or remove repositories and users,
+// and administrate every repository regardless of the access rules.
+func userAdmin(name string) bool {
+	if !userExist(name) || userDisabled(name) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(userRoot, name, "ADMIN"))
+	return err == nil
+}
+
+// hasAdmin checks there is at least one admin.
+func hasAdmin() bool {
+	users, err := listUsers()
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	for _, u := range users {
+		if u.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+func setUserAdmin(name string, admin bool) error {
+	if !userExist(name) {
+		return fmt.Errorf("user not exist: %v", name)
+	}
+	f := filepath.Join(userRoot, name, "ADMIN")
+	if !admin {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(f, []byte{}, 0600)
+}
+
+func addUser(name, passwd string) error {
+	if !userNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid user name: %v", name)
+	}
+	if userExist(name) {
+		return fmt.Errorf("user already exist: %v", name)
+	}
+	d := filepath.Join(userRoot, name)
+	err := os.MkdirAll(d, 0700)
+	if err != nil {
+		return fmt.Errorf("couldn't make user directory: %v: %v", name, err)
+	}
+	return setPassword(name, passwd)
+}
+
+func removeUser(name string) error {
+	if !userExist(name) {
+		return fmt.Errorf("user not exist: %v", name)
+	}
+	err := os.RemoveAll(filepath.Join(userRoot, name))
+	if err != nil {
+		return fmt.Errorf("couldn't remove user: %v: %v", name, err)
+	}
+	return nil
+}
+
+func setPassword(name, passwd string) error {
+	if passwd == "" {
+		return errors.New("password should not empty.")
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(userRoot, name, "PASSWORD"), h, 0600)
+}
+
+// setUserDisabled disables or enables the user.
+// Disabled user cannot pass any authentication, but the data will kept.
+func setUserDisabled(name string, disabled bool) error {
+	if !userExist(name) {
+		return fmt.Errorf("user not exist: %v", name)
+	}
+	f := filepath.Join(userRoot, name, "DISABLED")
+	if !disabled {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(f, []byte{}, 0600)
+}
+
+// checkPassword checks the user exist, enabled and the password matched.
+func checkPassword(name, passwd string) bool {
+	if !userExist(name) || userDisabled(name) {
+		compareDummyHash(passwd)
+		return false
+	}
+	h, err := ioutil.ReadFile(filepath.Join(userRoot, name, "PASSWORD"))
+	if err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(h, []byte(passwd)) == nil
+}